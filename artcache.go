@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	artCacheDirName     = "art"
+	artCachePartialGlob = ".partial-*"
+	artCacheDirPerm     = 0o700
+	artTokenParam       = "token"
+)
+
+var errArtworkTooLarge = errors.New("artwork larger than cache size")
+
+// artEntry is a cached artwork file, the file name is the key with the image extension.
+type artEntry struct {
+	key        string
+	name       string
+	size       int64
+	accessedAt time.Time
+}
+
+// artCache is a persistent artwork cache under `$XDG_CACHE_HOME/hassmpris/art`, the least
+// recently used files are evicted once the cache grows over maxSize, and files not used for
+// maxAge are removed. The access time is kept as the file modification time so the order
+// survives restarts.
+type artCache struct {
+	mux     sync.Mutex
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	maxEdge int // artwork.max_edge the cached artwork is normalized with
+	size    int64
+	entries map[string]*artEntry
+}
+
+// key returns the cache file name for the artwork path, regardless of its access token. The
+// normalization settings are part of the key, so the artwork normalized with the previous
+// settings is no longer served and eventually evicted.
+func (c *artCache) key(artPath string) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\x00%d", stripArtToken(artPath), c.maxEdge))
+	return base64.URLEncoding.EncodeToString(sum[:])
+}
+
+// stripArtToken returns the artwork path without the `token` query parameter, HASS rotates the
+// access token of the proxied `entity_picture` while the image stays the same.
+func stripArtToken(artPath string) string {
+	u, err := url.Parse(artPath)
+	if err != nil {
+		return artPath
+	}
+
+	query := u.Query()
+	if !query.Has(artTokenParam) {
+		return artPath
+	}
+
+	query.Del(artTokenParam)
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// fileURL returns the `file://` URL of the cache file.
+func (c *artCache) fileURL(name string) string {
+	u := url.URL{Scheme: "file", Path: filepath.Join(c.dir, name)}
+	return u.String()
+}
+
+// get returns the file URL of the cached artwork and marks it as recently used.
+func (c *artCache) get(key string) (fileURL string, ok bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(c.dir, e.name), now, now); err != nil {
+		log.Warn("artwork cache file vanished", "name", e.name, "err", err)
+		c.drop(e)
+
+		return "", false
+	}
+
+	e.accessedAt = now
+
+	return c.fileURL(e.name), true
+}
+
+// store writes r to the cache as key with the file extension ext, the content is written into a
+// partial file first and renamed when completed, so an interrupted download never becomes a
+// cache hit.
+func (c *artCache) store(key, ext string, r io.Reader) (fileURL string, err error) {
+	tmp, err := os.CreateTemp(c.dir, artCachePartialGlob)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	size, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if c.maxSize > 0 && size > c.maxSize {
+		err = errArtworkTooLarge
+		return "", err
+	}
+
+	name := key + ext
+	if err = os.Rename(tmp.Name(), filepath.Join(c.dir, name)); err != nil {
+		return "", err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if old, ok := c.entries[key]; ok {
+		if old.name != name {
+			c.drop(old)
+		} else {
+			c.size -= old.size
+		}
+	}
+
+	c.entries[key] = &artEntry{key: key, name: name, size: size, accessedAt: time.Now()}
+	c.size += size
+	c.evict()
+
+	return c.fileURL(name), nil
+}
+
+// drop forgets the entry and removes its file, c.mux must already be locked.
+func (c *artCache) drop(e *artEntry) {
+	err := os.Remove(filepath.Join(c.dir, e.name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Error("remove artwork cache file failed", "name", e.name, "err", err)
+	}
+
+	c.size -= e.size
+	delete(c.entries, e.key)
+}
+
+// evict removes the expired entries then the least recently used entries until the cache fits
+// in maxSize, c.mux must already be locked.
+func (c *artCache) evict() {
+	entries := slices.SortedFunc(maps.Values(c.entries), func(a, b *artEntry) int {
+		return a.accessedAt.Compare(b.accessedAt)
+	})
+
+	expired := time.Now().Add(-c.maxAge)
+
+	for _, e := range entries {
+		fresh := c.maxAge <= 0 || e.accessedAt.After(expired)
+		if fresh && (c.maxSize <= 0 || c.size <= c.maxSize) {
+			break
+		}
+
+		log.Debug("evict artwork from cache", "name", e.name, "accessed", e.accessedAt)
+		c.drop(e)
+	}
+}
+
+// load indexes the existing cache files and removes the partial files left by an interrupted
+// download.
+func (c *artCache) load() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		if ok, _ := filepath.Match(artCachePartialGlob, f.Name()); ok {
+			log.Info("remove orphaned partial artwork", "name", f.Name())
+
+			if err := os.Remove(filepath.Join(c.dir, f.Name())); err != nil {
+				log.Error("remove orphaned partial artwork failed", "err", err)
+			}
+
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+
+		key := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		if _, ok := c.entries[key]; ok {
+			log.Info("remove duplicated artwork", "name", f.Name())
+
+			if err := os.Remove(filepath.Join(c.dir, f.Name())); err != nil {
+				log.Error("remove duplicated artwork failed", "err", err)
+			}
+
+			continue
+		}
+
+		c.entries[key] = &artEntry{
+			key:        key,
+			name:       f.Name(),
+			size:       info.Size(),
+			accessedAt: info.ModTime(),
+		}
+		c.size += info.Size()
+	}
+
+	c.evict()
+
+	return nil
+}
+
+// defaultArtCacheDir returns `$XDG_CACHE_HOME/hassmpris/art`.
+func defaultArtCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, configDirName, artCacheDirName), nil
+}
+
+func newArtCache(cfg artworkConfig) (*artCache, error) {
+	dir := cfg.CacheDir
+	if dir == "" {
+		var err error
+
+		if dir, err = defaultArtCacheDir(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(dir, artCacheDirPerm); err != nil {
+		return nil, err
+	}
+
+	c := &artCache{
+		dir:     dir,
+		maxSize: cfg.MaxSizeMB * 1024 * 1024,
+		maxAge:  cfg.MaxAge.Duration,
+		maxEdge: cfg.MaxEdge,
+		entries: make(map[string]*artEntry),
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	log.Info("artwork cache loaded", "dir", dir, "files", len(c.entries), "size", c.size)
+
+	return c, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+const (
+	mimeJPEG = "image/jpeg"
+	mimePNG  = "image/png"
+	mimeGIF  = "image/gif"
+	mimeWebP = "image/webp"
+	mimeBMP  = "image/bmp"
+
+	artworkJPEGQuality = 90
+)
+
+var errArtworkNotImage = errors.New("artwork is not a supported image")
+
+// artworkDecoders are the formats which can be normalized, the format is detected by content
+// sniffing instead of trusting the file name or Content-Type header.
+var artworkDecoders = map[string]func([]byte) (image.Image, error){
+	mimeJPEG: func(b []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(b)) },
+	mimePNG:  func(b []byte) (image.Image, error) { return png.Decode(bytes.NewReader(b)) },
+	mimeGIF:  func(b []byte) (image.Image, error) { return gif.Decode(bytes.NewReader(b)) },
+	mimeWebP: func(b []byte) (image.Image, error) { return webp.Decode(bytes.NewReader(b)) },
+	mimeBMP:  func(b []byte) (image.Image, error) { return bmp.Decode(bytes.NewReader(b)) },
+}
+
+// normalizeArtwork converts the artwork into PNG or JPEG which every desktop shell can render,
+// and downscales it so the longest edge fits in maxEdge (0 means unlimited). JPEG and PNG
+// artwork already fitting in maxEdge is kept as is. The returned ext matches the content.
+func normalizeArtwork(data []byte, maxEdge int) (out []byte, ext string, err error) {
+	mime := http.DetectContentType(data)
+
+	decode, ok := artworkDecoders[mime]
+	if !ok {
+		return nil, "", errArtworkNotImage
+	}
+
+	if mime == mimeJPEG || mime == mimePNG {
+		conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err == nil && (maxEdge <= 0 || max(conf.Width, conf.Height) <= maxEdge) {
+			return data, artworkExt(mime), nil
+		}
+	}
+
+	img, err := decode(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	img = downscale(img, maxEdge)
+
+	var buf bytes.Buffer
+
+	if mime == mimeJPEG || isOpaque(img) {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: artworkJPEGQuality})
+		mime = mimeJPEG
+	} else {
+		err = png.Encode(&buf, img)
+		mime = mimePNG
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), artworkExt(mime), nil
+}
+
+// downscale resizes img keeping the aspect ratio so the longest edge is maxEdge.
+func downscale(img image.Image, maxEdge int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	if maxEdge <= 0 || max(w, h) <= maxEdge {
+		return img
+	}
+
+	if w >= h {
+		w, h = maxEdge, max(1, h*maxEdge/w)
+	} else {
+		w, h = max(1, w*maxEdge/h), maxEdge
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+
+	return dst
+}
+
+// isOpaque reports whether img has no transparent pixel so it can be stored as JPEG.
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+
+	return false
+}
+
+func artworkExt(mime string) string {
+	if mime == mimePNG {
+		return ".png"
+	}
+
+	return ".jpg"
+}
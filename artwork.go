@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	artworkQueueSize   = 32
+	artworkMaxDownload = 32 * 1024 * 1024
+)
+
+var errArtworkQueueFull = errors.New("artwork download queue is full")
+
+// artJob is a pending artwork download, done is called with the file URL once it is cached.
+type artJob struct {
+	ctx     context.Context
+	artPath string
+	done    func(fileURL string)
+}
+
+// artFetcher downloads artwork into the [artCache] with a bounded pool of workers, so a slow
+// HASS image proxy never blocks the state updates.
+type artFetcher struct {
+	ctx     context.Context
+	http    *hassHTTP
+	cache   *artCache
+	maxEdge int
+	jobs    chan artJob
+}
+
+// cached returns the file URL of the artwork if it has been downloaded before.
+func (f *artFetcher) cached(artPath string) (fileURL string, ok bool) {
+	return f.cache.get(f.cache.key(artPath))
+}
+
+// submit queues the download without blocking, the job is dropped if the queue is full.
+func (f *artFetcher) submit(job artJob) error {
+	select {
+	case f.jobs <- job:
+		return nil
+	default:
+		return errArtworkQueueFull
+	}
+}
+
+func (f *artFetcher) worker() {
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case job := <-f.jobs:
+			if job.ctx.Err() != nil {
+				continue
+			}
+
+			fileURL, err := f.download(job.ctx, job.artPath)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					log.Error("download art work failed", "err", err, "url", job.artPath)
+				}
+
+				continue
+			}
+
+			job.done(fileURL)
+		}
+	}
+}
+
+func (f *artFetcher) download(ctx context.Context, artPath string) (string, error) {
+	resp, err := f.http.get(ctx, artPath)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, artworkMaxDownload))
+	if err != nil {
+		return "", err
+	}
+
+	data, ext, err := normalizeArtwork(data, f.maxEdge)
+	if err != nil {
+		return "", err
+	}
+
+	return f.cache.store(f.cache.key(artPath), ext, bytes.NewReader(data))
+}
+
+func newArtFetcher(
+	ctx context.Context,
+	hassHTTP *hassHTTP,
+	cache *artCache,
+	cfg artworkConfig,
+) *artFetcher {
+	f := &artFetcher{
+		ctx:     ctx,
+		http:    hassHTTP,
+		cache:   cache,
+		maxEdge: cfg.MaxEdge,
+		jobs:    make(chan artJob, artworkQueueSize),
+	}
+
+	for range cfg.Workers {
+		go f.worker()
+	}
+
+	return f
+}
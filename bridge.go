@@ -2,26 +2,17 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/base64"
-	"errors"
-	"fmt"
-	"io"
-	"net/http"
-	"net/url"
-	"os"
-	"path/filepath"
+	"maps"
+	"sync"
 	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/godbus/dbus/v5"
-	"github.com/godbus/dbus/v5/introspect"
-	"github.com/godbus/dbus/v5/prop"
 	"github.com/linnovs/hass-mpris-bridge/internal/hassmessage"
 )
 
 const (
-	dbusNameFormat       = dbusObjectIface + ".hassbridge.instance%d"
+	dbusNameFormat       = dbusObjectIface + ".hassbridge.%s"
 	dbusObjectPath       = "/org/mpris/MediaPlayer2"
 	dbusObjectIface      = "org.mpris.MediaPlayer2"
 	dbusPlayerIface      = dbusObjectIface + ".Player"
@@ -31,266 +22,345 @@ const (
 	desktopEntry         = "hassbridge"
 )
 
-// bridge is the D-bus object implementing `org.mpris.MediaPlayer2`.
+// bridge keeps one MPRIS [instance] per HASS `media_player` entity.
 type bridge struct {
-	ctx        context.Context
-	player     *player
-	conn       *dbus.Conn // shared connection don't close
-	errc       chan<- error
-	hassURL    *url.URL
-	dir        string
-	propsSpec  map[string]*prop.Prop
-	properties *prop.Properties
+	ctx          context.Context
+	client       *hassClient
+	cfg          *config
+	errc         chan<- error
+	fetcher      *artFetcher
+	instancesMux sync.Mutex
+	instances    map[string]*instance
 }
 
-// Raise do nothing.
-// see: https://specifications.freedesktop.org/mpris-spec/latest/Media_Player.html#Method:Raise
-func (b *bridge) Raise() *dbus.Error {
-	return nil
+func (b *bridge) close() {
+	b.instancesMux.Lock()
+	for entityID, inst := range b.instances {
+		inst.close()
+		delete(b.instances, entityID)
+	}
+	b.instancesMux.Unlock()
 }
 
-// Quit do nothing.
-// see: https://specifications.freedesktop.org/mpris-spec/latest/Media_Player.html#Method:Quit
-func (b *bridge) Quit() *dbus.Error {
-	return nil
+func (b *bridge) connect(errc chan<- error) {
+	b.errc = errc
 }
 
-func (b *bridge) close() {
-	if err := b.conn.Close(); err != nil {
-		log.Error("D-bus connection close failed", "err", err)
-	} else {
-		log.Info("disconnect from D-bus")
+// instance returns the MPRIS instance for the entity, a new one will be created and exported
+// on D-bus if the entity has not been seen before.
+func (b *bridge) instance(state hassmessage.State) (*instance, error) {
+	b.instancesMux.Lock()
+	defer b.instancesMux.Unlock()
+
+	if inst, ok := b.instances[state.EntityID]; ok {
+		return inst, nil
 	}
 
-	if err := os.RemoveAll(b.dir); err != nil {
-		log.Error("remove tempdir failed", "err", err)
-	} else {
-		log.Info("removed tempdir for art work files")
+	identity := b.cfg.entity(state.EntityID).Name
+	if identity == "" {
+		identity = state.FriendlyName()
 	}
-}
 
-func (b *bridge) props() map[string]*prop.Prop {
-	if b.propsSpec != nil {
-		return b.propsSpec
+	if identity == "" {
+		identity = desktopName
 	}
 
-	b.propsSpec = map[string]*prop.Prop{
-		"CanQuit":             {Value: false, Writable: false, Emit: prop.EmitTrue},
-		"Fullscreen":          {Value: false, Writable: false, Emit: prop.EmitTrue},
-		"CanSetFullscreen":    {Value: false, Writable: false, Emit: prop.EmitTrue},
-		"CanRaise":            {Value: false, Writable: false, Emit: prop.EmitTrue},
-		"HasTrackList":        {Value: false, Writable: false, Emit: prop.EmitTrue},
-		"Identity":            {Value: desktopName, Writable: false, Emit: prop.EmitTrue},
-		"DesktopEntry":        {Value: desktopEntry, Writable: false, Emit: prop.EmitTrue},
-		"SupportedUriSchemes": {Value: []string{}, Writable: false, Emit: prop.EmitTrue},
-		"SupportedMimeTypes":  {Value: []string{}, Writable: false, Emit: prop.EmitTrue},
+	inst, err := newInstance(b.ctx, b.client, state.EntityID, identity, b.cfg.OpenURI.schemes())
+	if err != nil {
+		return nil, err
 	}
 
-	return b.propsSpec
+	b.instances[state.EntityID] = inst
+
+	go b.detectQueue(inst, state.EntityID)
+
+	return inst, nil
 }
 
-func (b *bridge) export() (objIface, plyIface introspect.Interface, err error) {
-	if err := b.conn.Export(b, dbusObjectPath, dbusObjectIface); err != nil {
-		return objIface, plyIface, err
-	}
+// detectQueue enables the track list of the instance if the entity's integration exposes the
+// player's queue, the integration is looked up in the entity registry unless it is configured.
+func (b *bridge) detectQueue(inst *instance, entityID string) {
+	platform := b.cfg.entity(entityID).Queue
+	if platform == "" {
+		entry, err := b.client.entityRegistryEntry(b.ctx, entityID)
+		if err != nil {
+			log.Debug("get entity registry entry failed", "entity", entityID, "err", err)
+			return
+		}
 
-	if err := b.conn.Export(b.player, dbusObjectPath, dbusPlayerIface); err != nil {
-		return objIface, plyIface, err
+		platform = entry.Platform
 	}
 
-	props, err := prop.Export(b.conn, dbusObjectPath, map[string]map[string]*prop.Prop{
-		dbusObjectIface: b.props(),
-		dbusPlayerIface: b.player.props(),
-	})
-	if err != nil {
-		return objIface, plyIface, err
+	provider, ok := queueProviders[platform]
+	if !ok {
+		return
 	}
 
-	objIface.Methods = introspect.Methods(b)
-	objIface.Properties = props.Introspection(dbusObjectIface)
-	plyIface.Methods = introspect.Methods(b.player)
-	plyIface.Properties = props.Introspection(dbusPlayerIface)
-	b.properties = props
+	log.Info("enable player track list", "entity", entityID, "queue", platform)
+	inst.trackList.enable(provider)
+	inst.trackList.refresh()
+}
 
-	return objIface, plyIface, nil
+// bridged reports whether the entity has been exported as MPRIS instance.
+func (b *bridge) bridged(entityID string) bool {
+	b.instancesMux.Lock()
+	defer b.instancesMux.Unlock()
+
+	_, ok := b.instances[entityID]
+
+	return ok
 }
 
-func (b *bridge) updatePosition() {
-	for range time.Tick(time.Second) {
-		if ps, err := b.properties.Get(dbusPlayerIface, "PlaybackStatus"); err != nil {
-			log.Error("get PlaybackStatus property failed", "err", err)
-			continue
-		} else if ps.Value() != playbackPlaying {
-			continue
-		}
+// remove unexports and closes the MPRIS instance for the entity.
+func (b *bridge) remove(entityID string) {
+	b.instancesMux.Lock()
+	defer b.instancesMux.Unlock()
 
-		va, err := b.properties.Get(dbusPlayerIface, "Position")
-		if err != nil {
-			log.Error("get Position property failed", "err", err)
-			continue
-		}
+	inst, ok := b.instances[entityID]
+	if !ok {
+		return
+	}
+
+	inst.close()
+	delete(b.instances, entityID)
+	log.Info("removed player", "entity", entityID)
+}
+
+// disconnected keeps every MPRIS instance exported but marks them as stopped and without
+// any capabilities until the states are synced again.
+func (b *bridge) disconnected() {
+	b.instancesMux.Lock()
+	defer b.instancesMux.Unlock()
+
+	for entityID, inst := range b.instances {
+		inst.player.setFeatures(0)
+		inst.player.tracker.freeze(time.Now())
 
-		last, ok := va.Value().(int64)
-		if !ok {
-			log.Error("Position property has invalid type", "type", va.Value())
-			continue
+		props := inst.player.capabilities()
+		props["PlaybackStatus"] = dbus.MakeVariant(playbackStopped)
+
+		for k, v := range props {
+			inst.properties.SetMust(dbusPlayerIface, k, v)
 		}
 
-		next := last + (1000 * 1000) // add 1 second in microsecond
-		b.properties.SetMust(dbusPlayerIface, "Position", dbus.MakeVariant(next))
-		log.Debug("updated track position", "from", last, "to", next)
+		log.Info("mark player unavailable", "entity", entityID)
 	}
 }
 
-func (b *bridge) connect(errc chan<- error) (err error) {
-	name := fmt.Sprintf(dbusNameFormat, os.Getpid())
+// sync updates every MPRIS instance from states, and removes the instances which entity no
+// longer exists.
+func (b *bridge) sync(states []hassmessage.State) {
+	seen := make(map[string]bool, len(states))
+	stale := []string{}
 
-	reply, err := b.conn.RequestName(name, dbus.NameFlagDoNotQueue)
-	if err != nil {
-		return err
+	for _, state := range states {
+		seen[state.EntityID] = true
+		b.update(state)
 	}
 
-	if reply != dbus.RequestNameReplyPrimaryOwner {
-		return errors.New("D-bus name already taken")
+	b.instancesMux.Lock()
+	for entityID := range b.instances {
+		if !seen[entityID] {
+			stale = append(stale, entityID)
+		}
 	}
+	b.instancesMux.Unlock()
 
-	objIface, plyIface, err := b.export()
-	if err != nil {
-		return err
+	for _, entityID := range stale {
+		b.remove(entityID)
 	}
+}
 
-	b.errc = errc
-	n := introspect.NewIntrospectable(&introspect.Node{
-		Name: dbusObjectPath,
-		Interfaces: []introspect.Interface{
-			introspect.IntrospectData,
-			prop.IntrospectData,
-			objIface,
-			plyIface,
-		},
-	})
-
-	if err := b.conn.Export(n, dbusObjectPath, introspect.IntrospectData.Name); err != nil {
-		return err
+// artwork returns the artwork file URL of the instance's current track, the artwork which is
+// not cached yet is downloaded in background and published by [bridge.artworkReady], the
+// in-flight download is cancelled once the track changes. inst.artMux must already be locked.
+func (b *bridge) artwork(inst *instance, artPath string) string {
+	// a rotated access token is still the same artwork, keep the download in flight
+	if stripArtToken(artPath) == stripArtToken(inst.artPath) {
+		inst.artPath = artPath
+		return inst.artURL
 	}
 
-	log.Info("exported D-bus /org/mpris/MediaPlayer2", "name", name)
-	go b.updatePosition()
+	if inst.artCancel != nil {
+		inst.artCancel()
+		inst.artCancel = nil
+	}
 
-	return nil
-}
+	inst.artPath, inst.artURL = artPath, ""
 
-func (b *bridge) downloadArtwork(artPath string) string {
 	if artPath == "" {
 		return ""
 	}
 
-	sum := sha256.Sum256([]byte(artPath))
-	sumStr := base64.URLEncoding.EncodeToString(sum[:])
-	fileUrl := url.URL{Scheme: "file", Path: filepath.Join(b.dir, sumStr)}
-
-	if _, err := os.Stat(fileUrl.Path); !errors.Is(err, os.ErrNotExist) {
-		return fileUrl.String()
+	if fileURL, ok := b.fetcher.cached(artPath); ok {
+		inst.artURL = fileURL
+		return fileURL
 	}
 
-	out, err := os.Create(fileUrl.Path)
-	if err != nil {
-		log.Error("failed to create temp file for download artwork image", "err", err)
-
-		return ""
-	}
-	defer out.Close()
+	ctx, cancel := context.WithCancel(b.ctx)
 
-	artUrl, err := b.hassURL.Parse(artPath)
+	err := b.fetcher.submit(artJob{
+		ctx:     ctx,
+		artPath: artPath,
+		done:    func(fileURL string) { b.artworkReady(inst, artPath, fileURL) },
+	})
 	if err != nil {
-		log.Error("failed to parse art path for download URL", "err", err)
+		cancel()
+		log.Error("schedule art work download failed", "err", err, "url", artPath)
 
 		return ""
 	}
 
-	resp, err := http.Get(artUrl.String())
-	if err != nil || resp.StatusCode != http.StatusOK {
-		if err == nil {
-			err = errors.New(resp.Status)
-		}
+	inst.artCancel = cancel
 
-		log.Error("download art work failed", "err", err, "url", artPath)
+	return ""
+}
 
-		return ""
+// artworkReady adds the downloaded artwork to the metadata if the track has not changed.
+func (b *bridge) artworkReady(inst *instance, artPath, fileURL string) {
+	inst.artMux.Lock()
+	defer inst.artMux.Unlock()
+
+	if stripArtToken(inst.artPath) != stripArtToken(artPath) {
+		return
 	}
-	defer resp.Body.Close()
 
-	if _, err := io.Copy(out, resp.Body); err != nil {
-		log.Error("copy art work to file failed", "err", err)
+	inst.artURL, inst.artCancel = fileURL, nil
 
-		return ""
+	metadata := maps.Clone(inst.player.metadata())
+	metadata["mpris:artUrl"] = dbus.MakeVariant(fileURL)
+	inst.player.setProperty(dbusPlayerIface, "Metadata", dbus.MakeVariant(metadata))
+	log.Debug("update player artwork", "name", inst.name, "art", fileURL)
+}
+
+// updateMetadata publishes the metadata of state, with the artwork only if it is available.
+// The metadata is cleared once the player becomes idle or unavailable, so the previous track
+// does not linger.
+func (b *bridge) updateMetadata(
+	inst *instance,
+	state hassmessage.State,
+	status hassmessage.MediaPlayerAttrState,
+) {
+	inst.artMux.Lock()
+	defer inst.artMux.Unlock()
+
+	if status == hassmessage.MediaPlayerAttrStateIdle ||
+		status == hassmessage.MediaPlayerAttrStateUnavailable {
+		b.artwork(inst, "")
+		inst.properties.SetMust(dbusPlayerIface, "Metadata", dbus.MakeVariant(clearedMetadata()))
+
+		return
 	}
 
-	return fileUrl.String()
+	artURL := b.artwork(inst, state.ArtURL())
+	inst.properties.SetMust(dbusPlayerIface, "Metadata", dbus.MakeVariant(b.metadata(state, artURL)))
 }
 
 func (b *bridge) update(state hassmessage.State) {
-	if !state.IsMediaPlayer() || !state.IsMusicPlayer() {
+	if !state.IsMediaPlayer() || !b.cfg.allowed(state.EntityID) {
+		return
+	}
+
+	if !b.cfg.Content.allowed(state.ContentType(), b.bridged(state.EntityID)) {
+		log.Debug("skip content type", "entity", state.EntityID, "type", state.ContentType())
+		// the player would go stale if it is kept, it is exported again once allowed
+		b.remove(state.EntityID)
+
 		return
 	}
 
+	status := b.cfg.playbackState(state)
+
 	props := map[string]dbus.Variant{
-		"PlaybackStatus": dbus.MakeVariant(state.PlaybackState().String()),
+		"PlaybackStatus": dbus.MakeVariant(status.String()),
 		"LoopStatus":     dbus.MakeVariant(state.Repeat().String()),
 		"Shuffle":        dbus.MakeVariant(state.Shuffle()),
 		"Volume":         dbus.MakeVariant(state.Volume()),
-		"Position":       dbus.MakeVariant(state.Position()),
 	}
 
-	if state.Title() != "" && state.Artist() != "" {
-		props["Metadata"] = dbus.MakeVariant(map[string]dbus.Variant{
-			"mpris:length": dbus.MakeVariant(state.Duration()),
-			"mpris:artUrl": dbus.MakeVariant(b.downloadArtwork(state.ArtURL())),
-			"xesam:album":  dbus.MakeVariant(state.Album()),
-			"xesam:artist": dbus.MakeVariant(state.Artist()),
-			"xesam:title":  dbus.MakeVariant(state.Title()),
-		})
+	inst, err := b.instance(state)
+	if err != nil {
+		log.Error("create MPRIS player failed", "entity", state.EntityID, "err", err)
+		return
+	}
+
+	if state.LastUpdated.Before(inst.updatedAt) {
+		log.Debug("skip stale state", "entity", state.EntityID, "updated", state.LastUpdated)
+		return
 	}
 
+	inst.updatedAt = state.LastUpdated
+
 	log.Info(
 		"update player status",
+		"entity", state.EntityID,
 		"status", props["PlaybackStatus"].Value(),
 		"loop", props["LoopStatus"].Value(),
 		"shuffle", props["Shuffle"].Value(),
+		"type", state.ContentType(),
 		"album", state.Album(),
 		"title", state.Title(),
 		"artist", state.Artist(),
 	)
 
-	for k, v := range props {
-		b.properties.SetMust(dbusPlayerIface, k, v)
+	features := b.cfg.entity(state.EntityID).Capabilities.apply(state.SupportedFeatures())
+	if status == hassmessage.MediaPlayerAttrStateUnavailable {
+		features = 0
 	}
 
-	b.player.setEntityID(state.EntityID)
-}
+	if inst.player.setFeatures(features) {
+		log.Info("update player capabilities", "entity", state.EntityID, "features", features)
 
-func newBridge(ctx context.Context, client *hassClient) (b *bridge, err error) {
-	conn, err := dbus.SessionBus()
-	if err != nil {
-		return nil, err
+		for k, v := range inst.player.capabilities() {
+			props[k] = v
+		}
+
+		for k, v := range inst.trackList.capabilities() {
+			inst.properties.SetMust(dbusTrackListIface, k, v)
+		}
+
+		go inst.playlists.refresh()
 	}
 
-	hassurl, err := url.Parse(os.Getenv("HASS_URI"))
-	if err != nil {
-		return nil, err
+	b.updateMetadata(inst, state, status)
+
+	for k, v := range props {
+		inst.properties.SetMust(dbusPlayerIface, k, v)
+	}
+
+	if inst.trackList.changed(state) {
+		go inst.trackList.refresh()
+	}
+
+	inst.playlists.activate(state)
+
+	position := state.Position()
+	playing := status == hassmessage.MediaPlayerAttrStatePlaying
+
+	if inst.player.tracker.update(
+		position, state.Duration(), state.PositionUpdatedAt(), playing,
+	) {
+		log.Debug("player seeked", "entity", state.EntityID, "position", position)
+		inst.player.seeked(position)
 	}
-	hassurl = &url.URL{Scheme: "https", Host: hassurl.Host}
+}
 
-	dir, err := os.MkdirTemp("", "hassbridge")
+func newBridge(
+	ctx context.Context,
+	client *hassClient,
+	hassHTTP *hassHTTP,
+	cfg *config,
+) (b *bridge, err error) {
+	art, err := newArtCache(cfg.Artwork)
 	if err != nil {
 		return nil, err
 	}
 
 	return &bridge{
-		ctx:     ctx,
-		player:  &player{client: client},
-		hassURL: hassurl,
-		conn:    conn,
-		dir:     dir,
+		ctx:       ctx,
+		client:    client,
+		cfg:       cfg,
+		fetcher:   newArtFetcher(ctx, hassHTTP, art, cfg.Artwork),
+		instances: make(map[string]*instance),
 	}, nil
 }
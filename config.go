@@ -0,0 +1,527 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/linnovs/hass-mpris-bridge/internal/hassmessage"
+)
+
+const (
+	envkeyURI         = "HASS_URI"
+	envkeyToken       = "HASS_TOKEN"
+	envkeyDebug       = "DEBUG"
+	configDirName     = "hassmpris"
+	configFileName    = "config.toml"
+	configErrorIndent = "\n  "
+
+	defaultHTTPTimeout      = 30 * time.Second
+	defaultCommandTimeout   = 10 * time.Second
+	defaultMaxMissedPongs   = 2
+	defaultArtworkMaxSizeMB = 100
+	defaultArtworkMaxAge    = 30 * 24 * time.Hour
+	defaultArtworkWorkers   = 2
+	defaultArtworkMaxEdge   = 1024
+)
+
+var errInvalidConfig = errors.New("invalid configuration")
+
+// config is the configuration loaded from `$XDG_CONFIG_HOME/hassmpris/config.toml`, which can be
+// overridden by environment variables and command line flags.
+type config struct {
+	Connection connectionConfig         `toml:"connection"`
+	Entities   entitiesConfig           `toml:"entities"`
+	Content    contentConfig            `toml:"content"`
+	Artwork    artworkConfig            `toml:"artwork"`
+	Metadata   metadataConfig           `toml:"metadata"`
+	OpenURI    openURIConfig            `toml:"open_uri"`
+	Entity     map[string]*entityConfig `toml:"entity"`
+	Debug      bool                     `toml:"debug"`
+}
+
+type connectionConfig struct {
+	URI   string `toml:"uri"`
+	Token string `toml:"token"`
+	// Feed is either "entities" (default) for `subscribe_entities` or "state_changed" for the
+	// `state_changed` event bus.
+	Feed               string   `toml:"feed"`
+	CAFile             string   `toml:"ca_file"`
+	ClientCert         string   `toml:"client_cert"`
+	ClientKey          string   `toml:"client_key"`
+	InsecureSkipVerify bool     `toml:"insecure_skip_verify"`
+	Timeout            duration `toml:"timeout"`
+	// CommandTimeout is how long the result of a websocket command is awaited.
+	CommandTimeout duration `toml:"command_timeout"`
+	// MaxMissedPongs is how many pings in a row may be unanswered before the connection is
+	// considered dead and re-established.
+	MaxMissedPongs int `toml:"max_missed_pongs"`
+}
+
+// entitiesConfig is the allow and deny lists of entity ID glob patterns, e.g.,
+// `media_player.kitchen_*`, an empty allow list allows every `media_player` entity.
+type entitiesConfig struct {
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+}
+
+// duration is a [time.Duration] decoded from string, e.g., "720h".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// artworkConfig is the settings of the artwork cache, an empty cache dir means
+// `$XDG_CACHE_HOME/hassmpris/art` and a zero limit means unlimited.
+type artworkConfig struct {
+	CacheDir  string   `toml:"cache_dir"`
+	MaxSizeMB int64    `toml:"max_size_mb"`
+	MaxAge    duration `toml:"max_age"`
+	Workers   int      `toml:"workers"`
+	MaxEdge   int      `toml:"max_edge"`
+}
+
+// metadataConfig is the settings of how `media_title` is mapped to MPRIS metadata. A title
+// like "Artist - Title" reported without `media_artist`, e.g., by internet radio, is split at
+// the first separator found when SplitTitle is enabled.
+type metadataConfig struct {
+	SplitTitle      bool     `toml:"split_title"`
+	TitleSeparators []string `toml:"title_separators"`
+}
+
+// openURIConfig maps the URI schemes accepted by `OpenUri` to the `media_content_type` passed to
+// `media_player.play_media`, an empty content type disables the scheme.
+type openURIConfig struct {
+	Schemes map[string]string `toml:"schemes"`
+}
+
+// schemes returns the enabled URI schemes and their content type.
+func (c openURIConfig) schemes() map[string]string {
+	schemes := make(map[string]string, len(c.Schemes))
+
+	for scheme, contentType := range c.Schemes {
+		if contentType != "" {
+			schemes[strings.ToLower(scheme)] = contentType
+		}
+	}
+
+	return schemes
+}
+
+// contentConfig is the policy of which `media_content_type` should be bridged, an empty types
+// list bridges every content type.
+type contentConfig struct {
+	Types      []string `toml:"types"`
+	AllowEmpty *bool    `toml:"allow_empty"`
+}
+
+// allowed reports whether an entity playing contentType should be bridged, an entity that is
+// already bridged is kept when it reports no content type, e.g., when it becomes idle.
+func (c contentConfig) allowed(contentType string, bridged bool) bool {
+	if contentType == "" {
+		return bridged || c.AllowEmpty == nil || *c.AllowEmpty
+	}
+
+	return len(c.Types) == 0 || slices.Contains(c.Types, contentType)
+}
+
+// entityConfig is the per-entity settings under `[entity."media_player.<object_id>"]`.
+type entityConfig struct {
+	Name         string             `toml:"name"`
+	SplitTitle   *bool              `toml:"split_title"`
+	Capabilities capabilitiesConfig `toml:"capabilities"`
+	// Queue is the integration providing the queue for the track list, e.g., "sonos" or
+	// "music_assistant", it is looked up in the entity registry if empty, "none" disables it.
+	Queue string `toml:"queue"`
+	// States overrides how the entity's states are mapped to playback states, e.g.,
+	// `{ on = "stopped" }`, see [playbackStates] for the names.
+	States map[string]string `toml:"states"`
+}
+
+// playbackStates are the names of the playback states used in the entity's states mapping.
+var playbackStates = map[string]hassmessage.MediaPlayerAttrState{
+	"playing":     hassmessage.MediaPlayerAttrStatePlaying,
+	"paused":      hassmessage.MediaPlayerAttrStatePaused,
+	"stopped":     hassmessage.MediaPlayerAttrStateStopped,
+	"idle":        hassmessage.MediaPlayerAttrStateIdle,
+	"unavailable": hassmessage.MediaPlayerAttrStateUnavailable,
+}
+
+// capabilitiesConfig overrides the capabilities derived from the entity's `supported_features`,
+// unset values keep what HASS reported.
+type capabilitiesConfig struct {
+	CanGoNext     *bool `toml:"can_go_next"`
+	CanGoPrevious *bool `toml:"can_go_previous"`
+	CanPlay       *bool `toml:"can_play"`
+	CanPause      *bool `toml:"can_pause"`
+	CanSeek       *bool `toml:"can_seek"`
+	CanStop       *bool `toml:"can_stop"`
+	Volume        *bool `toml:"volume"`
+	Shuffle       *bool `toml:"shuffle"`
+	LoopStatus    *bool `toml:"loop_status"`
+}
+
+// apply returns features with the overridden capabilities set or cleared.
+func (c capabilitiesConfig) apply(
+	features hassmessage.MediaPlayerFeature,
+) hassmessage.MediaPlayerFeature {
+	overrides := []struct {
+		value   *bool
+		feature hassmessage.MediaPlayerFeature
+	}{
+		{c.CanGoNext, hassmessage.MediaPlayerFeatureNextTrack},
+		{c.CanGoPrevious, hassmessage.MediaPlayerFeaturePreviousTrack},
+		{c.CanPlay, hassmessage.MediaPlayerFeaturePlay},
+		{c.CanPause, hassmessage.MediaPlayerFeaturePause},
+		{c.CanSeek, hassmessage.MediaPlayerFeatureSeek},
+		{c.CanStop, hassmessage.MediaPlayerFeatureStop},
+		{c.Volume, hassmessage.MediaPlayerFeatureVolumeSet},
+		{c.Shuffle, hassmessage.MediaPlayerFeatureShuffleSet},
+		{c.LoopStatus, hassmessage.MediaPlayerFeatureRepeatSet},
+	}
+
+	for _, o := range overrides {
+		switch {
+		case o.value == nil:
+		case *o.value:
+			features |= o.feature
+		default:
+			features &^= o.feature
+		}
+	}
+
+	return features
+}
+
+// entity returns the settings of entityID, the zero value is returned if there is none.
+func (c *config) entity(entityID string) entityConfig {
+	if e, ok := c.Entity[entityID]; ok && e != nil {
+		return *e
+	}
+
+	return entityConfig{}
+}
+
+// playbackState returns the playback state of the entity's state, with the entity's states
+// mapping applied.
+func (c *config) playbackState(state hassmessage.State) hassmessage.MediaPlayerAttrState {
+	if name, ok := c.entity(state.EntityID).States[state.State]; ok {
+		return playbackStates[name]
+	}
+
+	return state.PlaybackState()
+}
+
+// titleSeparators returns the separators to split `media_title` of entityID, nil if the title
+// should not be split.
+func (c *config) titleSeparators(entityID string) []string {
+	split := c.Metadata.SplitTitle
+	if e := c.entity(entityID); e.SplitTitle != nil {
+		split = *e.SplitTitle
+	}
+
+	if !split {
+		return nil
+	}
+
+	return c.Metadata.TitleSeparators
+}
+
+// allowed reports whether entityID passes the allow and deny lists.
+func (c *config) allowed(entityID string) bool {
+	for _, pattern := range c.Entities.Deny {
+		if ok, _ := path.Match(pattern, entityID); ok {
+			return false
+		}
+	}
+
+	if len(c.Entities.Allow) == 0 {
+		return true
+	}
+
+	for _, pattern := range c.Entities.Allow {
+		if ok, _ := path.Match(pattern, entityID); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowedMediaPlayer reports whether entityID is an allowed `media_player` entity.
+func (c *config) allowedMediaPlayer(entityID string) bool {
+	return strings.HasPrefix(entityID, hassmessage.MediaPlayerPrefix) && c.allowed(entityID)
+}
+
+// validate reports every invalid setting at once.
+func (c *config) validate() error {
+	var errs []string
+
+	if c.Connection.URI == "" {
+		errs = append(errs, fmt.Sprintf(
+			"connection.uri: is required (set it in config file, %s or -uri)", envkeyURI,
+		))
+	} else if u, err := url.Parse(c.Connection.URI); err != nil {
+		errs = append(errs, fmt.Sprintf("connection.uri: %s", err))
+	} else if u.Scheme != "ws" && u.Scheme != "wss" {
+		errs = append(errs, fmt.Sprintf(
+			"connection.uri: scheme must be ws or wss, got %q", u.Scheme,
+		))
+	}
+
+	if f := c.Connection.Feed; f != feedEntities && f != feedStateChanged {
+		errs = append(errs, fmt.Sprintf(
+			"connection.feed: must be %q or %q, got %q", feedEntities, feedStateChanged, f,
+		))
+	}
+
+	if (c.Connection.ClientCert == "") != (c.Connection.ClientKey == "") {
+		errs = append(errs, "connection.client_cert, connection.client_key: must be set together")
+	}
+
+	if c.Connection.Timeout.Duration < 0 {
+		errs = append(errs, fmt.Sprintf(
+			"connection.timeout: must not be negative, got %s", c.Connection.Timeout,
+		))
+	}
+
+	if c.Connection.CommandTimeout.Duration <= 0 {
+		errs = append(errs, fmt.Sprintf(
+			"connection.command_timeout: must be positive, got %s", c.Connection.CommandTimeout,
+		))
+	}
+
+	if c.Connection.MaxMissedPongs < 1 {
+		errs = append(errs, fmt.Sprintf(
+			"connection.max_missed_pongs: must be at least 1, got %d", c.Connection.MaxMissedPongs,
+		))
+	}
+
+	if c.Connection.Token == "" {
+		errs = append(errs, fmt.Sprintf(
+			"connection.token: is required (set it in config file, %s or -token)", envkeyToken,
+		))
+	}
+
+	for _, list := range []struct {
+		key      string
+		patterns []string
+	}{
+		{"entities.allow", c.Entities.Allow},
+		{"entities.deny", c.Entities.Deny},
+	} {
+		for n, pattern := range list.patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Sprintf("%s[%d]: %q: %s", list.key, n, pattern, err))
+			}
+		}
+	}
+
+	for n, contentType := range c.Content.Types {
+		if contentType == "" {
+			errs = append(errs, fmt.Sprintf("content.types[%d]: must not be empty", n))
+		}
+	}
+
+	for n, sep := range c.Metadata.TitleSeparators {
+		if strings.TrimSpace(sep) == "" {
+			errs = append(errs, fmt.Sprintf("metadata.title_separators[%d]: must not be blank", n))
+		}
+	}
+
+	for _, scheme := range slices.Sorted(maps.Keys(c.OpenURI.Schemes)) {
+		if u, err := url.Parse(scheme + ":"); err != nil || !strings.EqualFold(u.Scheme, scheme) {
+			errs = append(errs, fmt.Sprintf("open_uri.schemes.%q: not a valid URI scheme", scheme))
+		}
+	}
+
+	if c.Artwork.MaxSizeMB < 0 {
+		errs = append(errs, fmt.Sprintf(
+			"artwork.max_size_mb: must not be negative, got %d", c.Artwork.MaxSizeMB,
+		))
+	}
+
+	if c.Artwork.MaxAge.Duration < 0 {
+		errs = append(errs, fmt.Sprintf(
+			"artwork.max_age: must not be negative, got %s", c.Artwork.MaxAge,
+		))
+	}
+
+	if c.Artwork.MaxEdge < 0 {
+		errs = append(errs, fmt.Sprintf(
+			"artwork.max_edge: must not be negative, got %d", c.Artwork.MaxEdge,
+		))
+	}
+
+	if c.Artwork.Workers < 1 {
+		errs = append(errs, fmt.Sprintf(
+			"artwork.workers: must be at least 1, got %d", c.Artwork.Workers,
+		))
+	}
+
+	for _, entityID := range slices.Sorted(maps.Keys(c.Entity)) {
+		if !strings.HasPrefix(entityID, hassmessage.MediaPlayerPrefix) {
+			errs = append(errs, fmt.Sprintf(
+				"entity.%q: not a %s entity", entityID, hassmessage.MediaPlayerPrefix,
+			))
+		}
+
+		e := c.entity(entityID)
+		if _, ok := queueProviders[e.Queue]; !ok && e.Queue != "" && e.Queue != queueNone {
+			errs = append(errs, fmt.Sprintf(
+				"entity.%q.queue: must be one of %s or %q, got %q", entityID,
+				strings.Join(slices.Sorted(maps.Keys(queueProviders)), ", "), queueNone, e.Queue,
+			))
+		}
+
+		for _, state := range slices.Sorted(maps.Keys(e.States)) {
+			if _, ok := playbackStates[e.States[state]]; !ok {
+				errs = append(errs, fmt.Sprintf(
+					"entity.%q.states.%s: must be one of %s, got %q", entityID, state,
+					strings.Join(slices.Sorted(maps.Keys(playbackStates)), ", "), e.States[state],
+				))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w:%s%s", errInvalidConfig,
+			configErrorIndent, strings.Join(errs, configErrorIndent))
+	}
+
+	return nil
+}
+
+// defaultConfigPath returns `$XDG_CONFIG_HOME/hassmpris/config.toml`.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, configDirName, configFileName)
+}
+
+// decodeConfigFile decodes the TOML file into cfg, unknown keys are reported as error.
+func decodeConfigFile(filename string, cfg *config) error {
+	md, err := toml.DecodeFile(filename, cfg)
+	if perr := (toml.ParseError{}); errors.As(err, &perr) {
+		return fmt.Errorf("%w: %s: %s", errInvalidConfig, filename, perr.ErrorWithPosition())
+	} else if err != nil {
+		return fmt.Errorf("%w: %s: %w", errInvalidConfig, filename, err)
+	}
+
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+
+		return fmt.Errorf("%w: %s: unknown keys:%s%s", errInvalidConfig, filename,
+			configErrorIndent, strings.Join(keys, configErrorIndent))
+	}
+
+	return nil
+}
+
+// loadConfig loads the configuration, the precedence from lowest to highest is config file,
+// environment variables then command line flags.
+func loadConfig(args []string) (*config, error) {
+	var (
+		cfg = config{
+			Connection: connectionConfig{
+				Feed:           feedEntities,
+				Timeout:        duration{defaultHTTPTimeout},
+				CommandTimeout: duration{defaultCommandTimeout},
+				MaxMissedPongs: defaultMaxMissedPongs,
+			},
+			Artwork: artworkConfig{
+				MaxSizeMB: defaultArtworkMaxSizeMB,
+				MaxAge:    duration{defaultArtworkMaxAge},
+				Workers:   defaultArtworkWorkers,
+				MaxEdge:   defaultArtworkMaxEdge,
+			},
+			Metadata: metadataConfig{
+				SplitTitle:      true,
+				TitleSeparators: []string{" - ", " – ", " — "},
+			},
+			OpenURI: openURIConfig{
+				Schemes: map[string]string{
+					"http":         hassmessage.MediaContentTypeMusic,
+					"https":        hassmessage.MediaContentTypeMusic,
+					"spotify":      hassmessage.MediaContentTypeMusic,
+					"media-source": hassmessage.MediaContentTypeMusic,
+				},
+			},
+		}
+		filename string
+		uri      string
+		token    string
+		debug    bool
+	)
+
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	fs.StringVar(&filename, "config", "", "path to config file (default "+
+		defaultConfigPath()+")")
+	fs.StringVar(&uri, "uri", "", "HASS websocket URI, e.g., wss://hass.local/api/websocket")
+	fs.StringVar(&token, "token", "", "HASS long-lived access token")
+	fs.BoolVar(&debug, "debug", false, "enable debug logging")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	explicit := filename != ""
+	if !explicit {
+		filename = defaultConfigPath()
+	}
+
+	if filename != "" {
+		err := decodeConfigFile(filename, &cfg)
+		if err != nil && (explicit || !errors.Is(err, os.ErrNotExist)) {
+			return nil, err
+		}
+	}
+
+	if v := os.Getenv(envkeyURI); v != "" {
+		cfg.Connection.URI = v
+	}
+
+	if v := os.Getenv(envkeyToken); v != "" {
+		cfg.Connection.Token = v
+	}
+
+	if os.Getenv(envkeyDebug) == "true" {
+		cfg.Debug = true
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "uri":
+			cfg.Connection.URI = uri
+		case "token":
+			cfg.Connection.Token = token
+		case "debug":
+			cfg.Debug = debug
+		}
+	})
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
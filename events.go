@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"github.com/linnovs/hass-mpris-bridge/internal/hassmessage"
+)
+
+// entityFilter reports whether the events of the entity should be delivered.
+type entityFilter func(entityID string) bool
+
+// eventEntity is the part of event data shared by the entity events, e.g., `state_changed` and
+// `entity_registry_updated`.
+type eventEntity struct {
+	EntityID string `json:"entity_id"`
+}
+
+// eventSubscription is a `subscribe_events` subscription delivering the event data decoded as T,
+// it is renewed after reconnect until [eventSubscription.unsubscribe].
+type eventSubscription[T any] struct {
+	client    *hassClient
+	sub       *subscription
+	evtType   hassmessage.EventType
+	filter    entityFilter
+	out       chan T
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// subscribeEvent subscribes to the events of evtType, only the events which `entity_id` passes
+// filter are delivered unless filter is nil.
+func subscribeEvent[T any](
+	c *hassClient,
+	evtType hassmessage.EventType,
+	filter entityFilter,
+) (*eventSubscription[T], error) {
+	sub, err := c.addSubscription(hassmessage.Command{
+		Type:      hassmessage.TypeCommandSubscribeEvent,
+		EventType: evtType,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("subscribe to HASS event", "event", evtType)
+
+	s := &eventSubscription[T]{
+		client:  c,
+		sub:     sub,
+		evtType: evtType,
+		filter:  filter,
+		out:     make(chan T, subscriptionBufferSize),
+		done:    make(chan struct{}),
+	}
+
+	go s.forward()
+
+	return s, nil
+}
+
+// forward decodes the events of the subscription, the events failed to decode are dropped.
+func (s *eventSubscription[T]) forward() {
+	for {
+		var msg hassmessage.Message
+
+		select {
+		case <-s.client.ctx.Done():
+			return
+		case <-s.done:
+			return
+		case msg = <-s.sub.events.messages():
+		}
+
+		if msg.Event.EventType != s.evtType {
+			continue
+		}
+
+		if s.filter != nil {
+			var entity eventEntity
+
+			if err := json.Unmarshal(msg.Event.Data, &entity); err != nil {
+				log.Error("unmarshal event entity failed", "event", s.evtType, "err", err)
+				continue
+			}
+
+			if !s.filter(entity.EntityID) {
+				continue
+			}
+		}
+
+		var data T
+
+		if err := json.Unmarshal(msg.Event.Data, &data); err != nil {
+			log.Error("unmarshal event data failed", "event", s.evtType, "err", err)
+			continue
+		}
+
+		select {
+		case s.out <- data:
+		case <-s.done:
+			return
+		case <-s.client.ctx.Done():
+			return
+		}
+	}
+}
+
+// events returns the channel receiving the decoded event data.
+func (s *eventSubscription[T]) events() <-chan T {
+	return s.out
+}
+
+// unsubscribe stops the subscription with `unsubscribe_events`, no more events are delivered
+// even if HASS could not be told.
+func (s *eventSubscription[T]) unsubscribe() error {
+	s.closeOnce.Do(func() { close(s.done) })
+
+	if err := s.client.removeSubscription(s.sub); err != nil {
+		return err
+	}
+
+	log.Info("unsubscribe from HASS event", "event", s.evtType)
+
+	return nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/linnovs/hass-mpris-bridge/internal/hassmessage"
+)
+
+const (
+	fakeHASSToken   = "fake-token"
+	fakeHASSVersion = "2024.10.0"
+	testTimeout     = 5 * time.Second
+)
+
+// fakeSession is a single authenticated connection to [fakeHASS].
+type fakeSession struct {
+	conn          *websocket.Conn
+	commands      []hassmessage.Command
+	subscriptions map[uint64]hassmessage.EventType
+}
+
+// fakeHASS is an in-process Home Assistant websocket server, it speaks the auth handshake and
+// answers `call_service`, `get_states`, `subscribe_events`, `unsubscribe_events` and `ping`.
+// Every command received is recorded per connection, and the replies can be overridden to inject
+// failures.
+type fakeHASS struct {
+	*httptest.Server
+	t        *testing.T
+	mux      sync.Mutex
+	states   []map[string]any
+	replies  map[hassmessage.MessageType][]map[string]any // queued replies overriding the default
+	ignored  map[hassmessage.MessageType]bool             // command types never answered
+	sessions []*fakeSession
+	accepted chan int // index of every authenticated session
+}
+
+func newFakeHASS(t *testing.T) *fakeHASS {
+	t.Helper()
+
+	f := &fakeHASS{
+		t:        t,
+		replies:  make(map[hassmessage.MessageType][]map[string]any),
+		ignored:  make(map[hassmessage.MessageType]bool),
+		accepted: make(chan int, 16),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+// uri returns the websocket URI of the server.
+func (f *fakeHASS) uri() string {
+	return "ws" + strings.TrimPrefix(f.URL, "http") + "/api/websocket"
+}
+
+func (f *fakeHASS) serve(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.CloseNow()
+
+	ctx := r.Context()
+
+	authRequired := hassmessage.AuthRequired{
+		Type: hassmessage.TypeAuthRequired, Version: fakeHASSVersion,
+	}
+	if err := wsjson.Write(ctx, conn, &authRequired); err != nil {
+		return
+	}
+
+	var auth hassmessage.Auth
+	if err := wsjson.Read(ctx, conn, &auth); err != nil {
+		return
+	}
+
+	if auth.Type != hassmessage.TypeAuth || auth.Token != fakeHASSToken {
+		wsjson.Write(ctx, conn, &hassmessage.AuthResult{ //nolint:errcheck // closing anyway
+			Type: hassmessage.TypeAuthInvalid, Message: "Invalid access token or password",
+		})
+
+		return
+	}
+
+	authOK := hassmessage.AuthResult{Type: hassmessage.TypeAuthOK, Version: fakeHASSVersion}
+	if err := wsjson.Write(ctx, conn, &authOK); err != nil {
+		return
+	}
+
+	sess := &fakeSession{conn: conn, subscriptions: make(map[uint64]hassmessage.EventType)}
+
+	f.mux.Lock()
+	n := len(f.sessions)
+	f.sessions = append(f.sessions, sess)
+	f.mux.Unlock()
+
+	f.accepted <- n
+
+	for {
+		var cmd hassmessage.Command
+		if err := wsjson.Read(ctx, conn, &cmd); err != nil {
+			return
+		}
+
+		reply, ok := f.reply(sess, cmd)
+		if !ok {
+			continue
+		}
+
+		if err := wsjson.Write(ctx, conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// reply records the command and returns its reply, false if the command should not be answered.
+func (f *fakeHASS) reply(sess *fakeSession, cmd hassmessage.Command) (map[string]any, bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	sess.commands = append(sess.commands, cmd)
+
+	if f.ignored[cmd.Type] {
+		return nil, false
+	}
+
+	if queued := f.replies[cmd.Type]; len(queued) > 0 {
+		f.replies[cmd.Type] = queued[1:]
+
+		reply := map[string]any{"id": cmd.ID}
+		for k, v := range queued[0] {
+			reply[k] = v
+		}
+
+		return reply, true
+	}
+
+	result := map[string]any{"id": cmd.ID, "type": hassmessage.TypeResult, "success": true}
+
+	switch cmd.Type {
+	case hassmessage.TypePing:
+		return map[string]any{"id": cmd.ID, "type": hassmessage.TypePong}, true
+	case hassmessage.TypeGetStates:
+		result["result"] = append([]map[string]any{}, f.states...)
+	case hassmessage.TypeCallService:
+		result["result"] = map[string]any{"context": map[string]any{"id": "fake"}}
+	case hassmessage.TypeCommandSubscribeEvent:
+		sess.subscriptions[cmd.ID] = cmd.EventType
+	case hassmessage.TypeUnsubscribeEvents:
+		if _, ok := sess.subscriptions[cmd.Subscription]; !ok {
+			return resultError(cmd.ID, "not_found", "Subscription not found."), true
+		}
+
+		delete(sess.subscriptions, cmd.Subscription)
+	}
+
+	return result, true
+}
+
+func resultError(id uint64, code, message string) map[string]any {
+	return map[string]any{
+		"id":      id,
+		"type":    hassmessage.TypeResult,
+		"success": false,
+		"error":   map[string]any{"code": code, "message": message},
+	}
+}
+
+// setStates sets the states returned by `get_states`.
+func (f *fakeHASS) setStates(states ...map[string]any) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.states = states
+}
+
+// queueReply overrides the reply of the next command of the type, the ID is filled in.
+func (f *fakeHASS) queueReply(typ hassmessage.MessageType, reply map[string]any) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.replies[typ] = append(f.replies[typ], reply)
+}
+
+// fail makes the next command of the type fail with the error code and message.
+func (f *fakeHASS) fail(typ hassmessage.MessageType, code, message string) {
+	reply := resultError(0, code, message)
+	delete(reply, "id")
+
+	f.queueReply(typ, reply)
+}
+
+// ignore makes the commands of the type never answered.
+func (f *fakeHASS) ignore(typ hassmessage.MessageType) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.ignored[typ] = true
+}
+
+// session returns the nth session.
+func (f *fakeHASS) session(n int) *fakeSession {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if n >= len(f.sessions) {
+		f.t.Fatalf("fake HASS session %d not established", n)
+	}
+
+	return f.sessions[n]
+}
+
+// waitSession waits for the nth session to be authenticated.
+func (f *fakeHASS) waitSession(n int) {
+	f.t.Helper()
+
+	deadline := time.After(testTimeout)
+
+	for {
+		f.mux.Lock()
+		established := n < len(f.sessions)
+		f.mux.Unlock()
+
+		if established {
+			return
+		}
+
+		select {
+		case <-f.accepted:
+		case <-deadline:
+			f.t.Fatalf("fake HASS session %d not established", n)
+		}
+	}
+}
+
+// commands returns the commands of the type received by the nth session, every command is
+// returned if typ is empty.
+func (f *fakeHASS) commands(n int, typ hassmessage.MessageType) []hassmessage.Command {
+	sess := f.session(n)
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return slices.DeleteFunc(slices.Clone(sess.commands), func(cmd hassmessage.Command) bool {
+		return typ != "" && cmd.Type != typ
+	})
+}
+
+// subscriptions returns the IDs of the subscriptions to the event type on the nth session.
+func (f *fakeHASS) subscriptions(n int, evtType hassmessage.EventType) []uint64 {
+	sess := f.session(n)
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	ids := []uint64{}
+
+	for id, t := range sess.subscriptions {
+		if t == evtType {
+			ids = append(ids, id)
+		}
+	}
+
+	slices.Sort(ids)
+
+	return ids
+}
+
+// event sends the event to every subscription to its type on the nth session.
+func (f *fakeHASS) event(n int, evtType hassmessage.EventType, data map[string]any) {
+	f.t.Helper()
+
+	for _, id := range f.subscriptions(n, evtType) {
+		f.send(n, map[string]any{
+			"id":    id,
+			"type":  "event",
+			"event": map[string]any{"event_type": evtType, "data": data},
+		})
+	}
+}
+
+// stateChanged sends the `state_changed` event of the entity on the nth session, the entity is
+// removed if newState is nil.
+func (f *fakeHASS) stateChanged(n int, entityID string, newState map[string]any) {
+	f.t.Helper()
+
+	f.event(n, hassmessage.EventStateChanged, map[string]any{
+		"entity_id": entityID,
+		"new_state": newState,
+	})
+}
+
+// send writes the message to the nth session.
+func (f *fakeHASS) send(n int, msg map[string]any) {
+	f.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if err := wsjson.Write(ctx, f.session(n).conn, msg); err != nil {
+		f.t.Fatalf("fake HASS send message: %v", err)
+	}
+}
+
+// drop closes the nth session without a close handshake, like a lost connection.
+func (f *fakeHASS) drop(n int) {
+	f.session(n).conn.CloseNow()
+}
+
+// mediaPlayerState returns a `media_player` state as sent by HASS.
+func mediaPlayerState(entityID, state string, attrs map[string]any) map[string]any {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	return map[string]any{
+		"entity_id":    entityID,
+		"state":        state,
+		"attributes":   attrs,
+		"last_changed": now,
+		"last_updated": now,
+	}
+}
+
+// newTestClient connects a [hassClient] to the fake server, the client is closed once the test
+// ends. Unexpected errors of the client are reported to errc.
+func newTestClient(t *testing.T, f *fakeHASS) (client *hassClient, errc chan error) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc = make(chan error, 1)
+	client = newHASSClient(ctx, f.Client(), time.Second, 2)
+
+	if err := client.connect(f.uri(), fakeHASSToken, errc); err != nil {
+		cancel()
+		t.Fatalf("connect to fake HASS: %v", err)
+	}
+
+	f.waitSession(0)
+
+	t.Cleanup(func() {
+		client.close()
+		cancel()
+	})
+
+	return client, errc
+}
+
+// waitConnState waits for the client to report the connection state.
+func waitConnState(t *testing.T, client *hassClient, errc <-chan error, want connState) {
+	t.Helper()
+
+	select {
+	case state := <-client.connStates():
+		if state != want {
+			t.Fatalf("connection state: got %v, want %v", state, want)
+		}
+	case err := <-errc:
+		t.Fatalf("unexpected client error: %v", err)
+	case <-time.After(testTimeout):
+		t.Fatalf("connection state %v not reported", want)
+	}
+}
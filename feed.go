@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+
+	"github.com/linnovs/hass-mpris-bridge/internal/hassmessage"
+)
+
+const (
+	feedEntities         = "entities"
+	feedStateChanged     = "state_changed"
+	registryActionCreate = "create"
+	registryActionUpdate = "update"
+)
+
+// entityFeed merges every `subscribe_entities` subscription into a single receiver, so entities
+// can be watched as they are created, and keeps the state cache the compressed diffs apply to.
+type entityFeed struct {
+	ctx     context.Context
+	client  *hassClient
+	cache   hassmessage.StateCache
+	watched map[string]bool
+	out     chan hassmessage.Message
+}
+
+// watch subscribes to the entities which are not yet watched.
+func (f *entityFeed) watch(entityIDs []string) error {
+	ids := make([]string, 0, len(entityIDs))
+
+	for _, entityID := range entityIDs {
+		if !f.watched[entityID] {
+			ids = append(ids, entityID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ch, err := f.client.subscribeEntities(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, entityID := range ids {
+		f.watched[entityID] = true
+	}
+
+	go f.forward(ch)
+
+	return nil
+}
+
+// registryUpdated watches the entity created or renamed in the entity registry, the removed
+// entities are reported by the subscription itself. The registry events should be filtered to
+// the allowed `media_player` entities.
+func (f *entityFeed) registryUpdated(data hassmessage.EntityRegistryUpdatedData) error {
+	if data.Action != registryActionCreate && data.Action != registryActionUpdate {
+		return nil
+	}
+
+	return f.watch([]string{data.EntityID})
+}
+
+func (f *entityFeed) forward(ch <-chan hassmessage.Message) {
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case msg := <-ch:
+			f.out <- msg
+		}
+	}
+}
+
+// apply applies the compressed diffs of the event to the cache, see [hassmessage.StateCache].
+func (f *entityFeed) apply(
+	msg hassmessage.Message,
+) (changed []hassmessage.State, removed []string) {
+	return f.cache.Apply(msg.Event)
+}
+
+func (f *entityFeed) messages() <-chan hassmessage.Message {
+	return f.out
+}
+
+func newEntityFeed(ctx context.Context, client *hassClient) *entityFeed {
+	return &entityFeed{
+		ctx:     ctx,
+		client:  client,
+		watched: make(map[string]bool),
+		out:     make(chan hassmessage.Message, subscriptionBufferSize),
+	}
+}
@@ -3,9 +3,11 @@ module github.com/linnovs/hass-mpris-bridge
 go 1.23.3
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/charmbracelet/log v0.4.0
 	github.com/coder/websocket v1.8.12
 	github.com/godbus/dbus/v5 v5.1.0
+	golang.org/x/image v0.28.0
 )
 
 require (
@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,78 +20,346 @@ import (
 )
 
 var (
-	errUnexpectedMsg = errors.New("unexpected message after command")
-	errCommandFailed = errors.New("command result failed")
+	errUnexpectedMsg  = errors.New("unexpected message after command")
+	errCommandFailed  = errors.New("command result failed")
+	errCommandTimeout = errors.New("command timed out")
+	errConnectionLost = errors.New("HASS websocket connection lost")
 )
 
-type hassClient struct {
-	ctx          context.Context
+const (
+	reconnectMinDelay      = time.Second
+	reconnectMaxDelay      = time.Minute
+	subscriptionBufferSize = 64
+	heartbeatInterval      = 45 * time.Second
+)
+
+// connState is sent to the channel returned by [hassClient.connStates] whenever the websocket
+// connection is lost or re-established.
+type connState int
+
+const (
+	connStateDisconnected connState = iota
+	connStateReconnected
+)
+
+// subscription is a subscription command which should be renewed after reconnect.
+type subscription struct {
+	cmd    hassmessage.Command
+	events *eventQueue
+	sess   *session // session the command was sent on
+	id     uint64   // message ID of the command in sess
+}
+
+// eventQueue delivers the events of a subscription in order without blocking the listener, the
+// events are queued while the receiver is busy, e.g., waiting for a command result which can
+// only be read by the listener.
+type eventQueue struct {
+	mux      sync.Mutex
+	queued   []hassmessage.Message
+	ready    chan struct{} // signalled once an event is queued
+	out      chan hassmessage.Message
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newEventQueue(ctx context.Context) *eventQueue {
+	q := &eventQueue{
+		ready: make(chan struct{}, 1),
+		out:   make(chan hassmessage.Message, subscriptionBufferSize),
+		done:  make(chan struct{}),
+	}
+
+	go q.run(ctx)
+
+	return q
+}
+
+// push queues the event, it never blocks.
+func (q *eventQueue) push(msg hassmessage.Message) {
+	q.mux.Lock()
+	q.queued = append(q.queued, msg)
+	q.mux.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the queued events until ctx is done or the queue is stopped.
+func (q *eventQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.done:
+			return
+		case <-q.ready:
+		}
+
+		for {
+			q.mux.Lock()
+			if len(q.queued) == 0 {
+				q.mux.Unlock()
+				break
+			}
+
+			msg := q.queued[0]
+			q.queued[0] = hassmessage.Message{}
+			q.queued = q.queued[1:]
+			q.mux.Unlock()
+
+			select {
+			case q.out <- msg:
+			case <-ctx.Done():
+				return
+			case <-q.done:
+				return
+			}
+		}
+	}
+}
+
+// messages returns the channel receiving the events in order.
+func (q *eventQueue) messages() <-chan hassmessage.Message {
+	return q.out
+}
+
+// stop stops delivering the events.
+func (q *eventQueue) stop() {
+	q.stopOnce.Do(func() { close(q.done) })
+}
+
+// session is a single authenticated websocket connection, the message IDs and their receivers
+// only live as long as the connection, so the IDs start over from 1 on every session.
+type session struct {
 	conn         *websocket.Conn
-	receiversMux sync.Mutex
-	receivers    map[uint64]chan hassmessage.Message
+	done         chan struct{} // closed once conn is lost
 	messageID    atomic.Uint64
+	receiversMux sync.Mutex
+	receivers    map[uint64]receiver
+	pingsMux     sync.Mutex
+	pings        map[uint64]time.Time // ping sent time of the unanswered pings
+}
+
+func newSession(conn *websocket.Conn) *session {
+	return &session{
+		conn:      conn,
+		done:      make(chan struct{}),
+		receivers: make(map[uint64]receiver),
+		pings:     make(map[uint64]time.Time),
+	}
 }
 
-func (c *hassClient) listen(errc chan<- error) {
+func (s *session) incrementID() uint64 {
+	return s.messageID.Add(1)
+}
+
+// receiver receives the messages of a command, the result is delivered apart from the events
+// so the command's result can't be taken by the reader of its events nor held up by them.
+type receiver struct {
+	result chan hassmessage.Message
+	events *eventQueue // every message goes to result if nil
+}
+
+// register registers the receiver of the messages with the ID, the returned channel receives
+// the result and events are delivered to events.
+func (s *session) register(id uint64, events *eventQueue) <-chan hassmessage.Message {
+	s.receiversMux.Lock()
+	defer s.receiversMux.Unlock()
+
+	r := receiver{result: make(chan hassmessage.Message, 1), events: events}
+	s.receivers[id] = r
+
+	return r.result
+}
+
+// release stops delivering the messages with the ID.
+func (s *session) release(id uint64) {
+	s.receiversMux.Lock()
+	defer s.receiversMux.Unlock()
+
+	delete(s.receivers, id)
+}
+
+// deliver delivers the message to its receiver without blocking, false if nobody is receiving
+// it. Only a single result is received for a message ID, so it never blocks on result.
+func (s *session) deliver(msg hassmessage.Message) bool {
+	s.receiversMux.Lock()
+	r, ok := s.receivers[msg.ID]
+	s.receiversMux.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if msg.Type == hassmessage.TypeResult || r.events == nil {
+		select {
+		case r.result <- msg:
+		default:
+			log.Warn("duplicated result dropped", "message", msg)
+		}
+
+		return true
+	}
+
+	r.events.push(msg)
+
+	return true
+}
+
+type hassClient struct {
+	ctx              context.Context
+	httpClient       *http.Client
+	uri              string
+	token            string
+	commandTimeout   time.Duration
+	maxMissedPongs   int
+	sessMux          sync.RWMutex
+	sess             *session
+	closed           atomic.Bool
+	states           chan connState
+	subscriptionsMux sync.Mutex
+	subscriptions    []*subscription
+}
+
+func (c *hassClient) getSession() *session {
+	c.sessMux.RLock()
+	defer c.sessMux.RUnlock()
+
+	return c.sess
+}
+
+// setSession starts a new session on conn, its receivers should be served by
+// [hassClient.listen].
+func (c *hassClient) setSession(conn *websocket.Conn) *session {
+	c.sessMux.Lock()
+	defer c.sessMux.Unlock()
+
+	c.sess = newSession(conn)
+
+	return c.sess
+}
+
+// isIDReuse reports whether HASS rejected the message ID as already used in the session.
+func isIDReuse(msg hassmessage.Message) bool {
+	return msg.Type == hassmessage.TypeReuseID ||
+		(msg.Type == hassmessage.TypeResult && msg.Error.Code == hassmessage.ErrorCodeIDReuse)
+}
+
+// listen delivers the messages of the session to their receivers until the connection is lost,
+// then the session is done, the commands waiting for their result fail with [errConnectionLost]
+// and the subscriptions are renewed after reconnect. The session is re-established as well if
+// HASS reports a reused message ID.
+func (c *hassClient) listen(sess *session, errc chan<- error) {
+	lost := false
+	conn := sess.conn
+
+	defer func() {
+		close(sess.done)
+
+		if lost {
+			go c.reconnect(errc)
+		}
+	}()
+
+	// connectionLost closes the connection to start over the reconnect, unless the client is
+	// closing.
+	connectionLost := func(err error) {
+		if c.closed.Load() || c.ctx.Err() != nil {
+			return
+		}
+
+		log.Error("HASS websocket connection lost", "err", err)
+		conn.Close(websocket.StatusGoingAway, "connection lost")
+		lost = true
+	}
+
 	for {
 		var msg hassmessage.Message
 
-		_, reader, err := c.conn.Reader(c.ctx)
+		_, reader, err := conn.Reader(c.ctx)
 		if err != nil {
-			errc <- err
+			connectionLost(err)
 			return
 		}
 
 		buf := bufferpool.Get()
 
+		// the connection may drop partway through a large frame, e.g., the `get_states` result
 		if _, err := buf.ReadFrom(reader); err != nil {
-			errc <- err
+			bufferpool.Put(buf)
+			connectionLost(err)
+
 			return
 		}
 
 		log.Debug("read message from HASS", "message", buf)
 
-		if err := json.Unmarshal(buf.Bytes(), &msg); err != nil {
-			errc <- err
-			return
+		err = json.Unmarshal(buf.Bytes(), &msg)
+		bufferpool.Put(buf)
+
+		if err != nil {
+			log.Error("decode HASS message failed, message skipped", "err", err)
+			continue
 		}
 
 		if msg.Type == hassmessage.TypePong {
-			log.Debug("pong message received", "id", msg.ID)
+			sess.pong(msg.ID)
 			continue
 		}
 
-		if msg.Type == hassmessage.TypeReuseID {
-			errc <- errors.New("HASS websocket id reuse, should recreate connection")
+		if isIDReuse(msg) {
+			log.Warn("HASS websocket message ID reused, re-establishing the session", "id", msg.ID)
+			conn.Close(websocket.StatusGoingAway, "message ID reused")
+			lost = true
+
 			return
 		}
 
-		c.receiversMux.Lock()
-		receiverCh, ok := c.receivers[msg.ID]
-		c.receiversMux.Unlock()
-		if !ok {
+		if !sess.deliver(msg) {
 			log.Warn("message received but no subscriber", "message", msg)
-			continue
-		}
-
-		select {
-		case receiverCh <- msg:
-		default:
-			go func() { receiverCh <- msg }()
 		}
 	}
 }
 
+// heartbeat sends a ping every [heartbeatInterval], the connection is considered dead and closed
+// to start over the reconnect once maxMissedPongs pings in a row are left unanswered.
 func (c *hassClient) heartbeat() {
-	const interval = 45 * time.Second
-
 	f := func() {
-		id := c.incrementID()
+		sess := c.getSession()
+
+		sess.pingsMux.Lock()
+		missed := len(sess.pings)
+		dead := missed >= c.maxMissedPongs
+		if dead {
+			clear(sess.pings)
+		}
+		sess.pingsMux.Unlock()
+
+		if dead {
+			log.Error("HASS websocket connection dead", "missed_pongs", missed)
+
+			// the listener notices the closed connection and starts over the reconnect
+			sess.conn.CloseNow()
+
+			return
+		}
+
+		id := sess.incrementID()
 		msg := hassmessage.Command{ID: id, Type: hassmessage.TypePing}
 
-		if err := wsjson.Write(c.ctx, c.conn, &msg); err != nil {
+		sess.pingsMux.Lock()
+		sess.pings[id] = time.Now()
+		sess.pingsMux.Unlock()
+
+		if err := wsjson.Write(c.ctx, sess.conn, &msg); err != nil {
 			log.Error("senting ping message failed", "err", err)
 
+			sess.pingsMux.Lock()
+			delete(sess.pings, id)
+			sess.pingsMux.Unlock()
+
 			return
 		}
 
@@ -96,7 +367,7 @@ func (c *hassClient) heartbeat() {
 	}
 
 	f()
-	for range time.Tick(interval) {
+	for range time.Tick(heartbeatInterval) {
 		select {
 		case <-c.ctx.Done():
 			return
@@ -106,10 +377,31 @@ func (c *hassClient) heartbeat() {
 	}
 }
 
-func (c *hassClient) connect(uri, token string, errc chan<- error) (err error) {
-	conn, _, err := websocket.Dial(c.ctx, uri, nil)
+// pong marks the ping and every earlier ping as answered, as the connection is still alive.
+func (s *session) pong(id uint64) {
+	s.pingsMux.Lock()
+	defer s.pingsMux.Unlock()
+
+	sentAt, ok := s.pings[id]
+	if !ok {
+		log.Debug("pong message received for unknown ping", "id", id)
+		return
+	}
+
+	for pingID := range s.pings {
+		if pingID <= id {
+			delete(s.pings, pingID)
+		}
+	}
+
+	log.Debug("pong message received", "id", id, "rtt", time.Since(sentAt))
+}
+
+// dial opens a new websocket connection and authenticates with the token.
+func (c *hassClient) dial() (_ *websocket.Conn, err error) {
+	conn, _, err := websocket.Dial(c.ctx, c.uri, &websocket.DialOptions{HTTPClient: c.httpClient})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer func() {
@@ -119,111 +411,356 @@ func (c *hassClient) connect(uri, token string, errc chan<- error) (err error) {
 	}()
 
 	var authRequired hassmessage.AuthRequired
-	if err := wsjson.Read(c.ctx, conn, &authRequired); err != nil {
-		return err
+	if err = wsjson.Read(c.ctx, conn, &authRequired); err != nil {
+		return nil, err
 	}
 
 	if authRequired.Type != hassmessage.TypeAuthRequired {
 		err = errors.New("unexpected first message")
-		return err
+		return nil, err
 	}
 
-	authMsg := hassmessage.Auth{Type: hassmessage.TypeAuth, Token: token}
-	if err := wsjson.Write(c.ctx, conn, &authMsg); err != nil {
-		return err
+	authMsg := hassmessage.Auth{Type: hassmessage.TypeAuth, Token: c.token}
+	if err = wsjson.Write(c.ctx, conn, &authMsg); err != nil {
+		return nil, err
 	}
 
 	var authResult hassmessage.AuthResult
-	if err := wsjson.Read(c.ctx, conn, &authResult); err != nil {
-		return err
+	if err = wsjson.Read(c.ctx, conn, &authResult); err != nil {
+		return nil, err
 	}
 
 	if authResult.Type != hassmessage.TypeAuthOK {
 		err = fmt.Errorf("authentication failed: %s", authResult.Message)
-		return err
+		return nil, err
 	}
 
 	log.Info("home assistant connected", "version", authResult.Version)
-	c.conn = conn
+
+	return conn, nil
+}
+
+func (c *hassClient) connect(uri, token string, errc chan<- error) (err error) {
+	c.uri, c.token = uri, token
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	sess := c.setSession(conn)
 
 	go c.heartbeat()
-	go c.listen(errc)
+	go c.listen(sess, errc)
 
 	return nil
 }
 
-func (c *hassClient) incrementID() uint64 {
-	return c.messageID.Add(1)
+// reconnect re-establishes the websocket connection with exponential backoff, renews every
+// subscription and then reports [connStateReconnected].
+func (c *hassClient) reconnect(errc chan<- error) {
+	c.setState(connStateDisconnected)
+
+	for attempt := 0; ; attempt++ {
+		delay := backoff(attempt)
+		log.Info("reconnecting to HASS websocket", "attempt", attempt+1, "delay", delay)
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		conn, err := c.dial()
+		if err != nil {
+			log.Error("reconnect to HASS websocket failed", "err", err)
+			continue
+		}
+
+		sess := c.setSession(conn)
+
+		go c.listen(sess, errc)
+
+		if err := c.resubscribe(); err != nil {
+			// closing the connection makes its listener start over the reconnect
+			log.Error("renew subscriptions failed", "err", err)
+			conn.Close(websocket.StatusInternalError, err.Error())
+
+			return
+		}
+
+		c.setState(connStateReconnected)
+
+		return
+	}
 }
 
-func (c *hassClient) commandDone(id uint64) {
-	c.receiversMux.Lock()
-	defer c.receiversMux.Unlock()
+// backoff returns the exponential delay with equal jitter for the reconnect attempt.
+func backoff(attempt int) time.Duration {
+	const maxShift = 16
+
+	delay := reconnectMaxDelay
+	if attempt < maxShift {
+		delay = min(reconnectMinDelay<<attempt, reconnectMaxDelay)
+	}
 
-	delete(c.receivers, id)
+	return delay/2 + rand.N(delay/2) //nolint:gosec // jitter needs no crypto random
 }
 
+func (c *hassClient) setState(state connState) {
+	select {
+	case c.states <- state:
+	case <-c.ctx.Done():
+	}
+}
+
+// connStates returns the channel receiving the connection state changes.
+func (c *hassClient) connStates() <-chan connState {
+	return c.states
+}
+
+// sendCommand sends the command and returns its result.
 func (c *hassClient) sendCommand(
+	ctx context.Context,
 	cmd hassmessage.Command,
-) (id uint64, msg hassmessage.Message, err error) {
-	ch := make(chan hassmessage.Message, 1)
-	cmd.ID = c.incrementID()
+) (msg hassmessage.Message, err error) {
+	sess, id, msg, err := c.sendCommandTo(ctx, cmd, nil)
+	if err == nil {
+		sess.release(id)
+	}
+
+	return msg, err
+}
+
+// sendCommandTo sends the command on the current session with events registered as the receiver
+// of its events, i.e., events of a subscription, until [session.release], events is nil if the
+// command has no events. The result is awaited until ctx is done, or the command timeout if ctx has
+// no deadline, and [errCommandTimeout] is returned once it expired.
+func (c *hassClient) sendCommandTo(
+	ctx context.Context,
+	cmd hassmessage.Command,
+	events *eventQueue,
+) (sess *session, id uint64, msg hassmessage.Message, err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, c.commandTimeout)
+		defer cancel()
+	}
+
+	sess = c.getSession()
+	cmd.ID = sess.incrementID()
+	result := sess.register(cmd.ID, events)
+
+	if err := wsjson.Write(ctx, sess.conn, &cmd); err != nil {
+		sess.release(cmd.ID)
+		return nil, 0, msg, commandContextError(ctx, err)
+	}
 
-	c.receiversMux.Lock()
-	c.receivers[cmd.ID] = ch
-	c.receiversMux.Unlock()
+	select {
+	case msg = <-result:
+	case <-sess.done:
+		sess.release(cmd.ID)
+		return nil, 0, msg, errConnectionLost
+	case <-ctx.Done():
+		sess.release(cmd.ID)
+		log.Error("HASS command timed out", "id", cmd.ID, "type", cmd.Type, "err", ctx.Err())
 
-	if err := wsjson.Write(c.ctx, c.conn, &cmd); err != nil {
-		c.commandDone(cmd.ID)
-		return 0, msg, err
+		return nil, 0, msg, commandContextError(ctx, ctx.Err())
 	}
 
-	msg = <-ch
 	if msg.Type != hassmessage.TypeResult {
-		c.commandDone(cmd.ID)
-		return 0, msg, errUnexpectedMsg
+		sess.release(cmd.ID)
+		return nil, 0, msg, errUnexpectedMsg
 	}
 
 	if !msg.Success {
-		c.commandDone(cmd.ID)
-		return 0, msg, errCommandFailed
+		sess.release(cmd.ID)
+		return nil, 0, msg, errCommandFailed
 	}
 
-	return cmd.ID, msg, nil
+	return sess, cmd.ID, msg, nil
 }
 
-func (c *hassClient) subscribe(evtType hassmessage.EventType) (<-chan hassmessage.Message, error) {
-	id, msg, err := c.sendCommand(hassmessage.Command{
-		Type:      hassmessage.TypeCommandSubscribeEvent,
-		EventType: evtType,
+// commandContextError wraps err with [errCommandTimeout] if the deadline of ctx has exceeded.
+func commandContextError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", errCommandTimeout, err)
+	}
+
+	return err
+}
+
+// sendCommandResult sends the command and decodes its result into T, a failed command is
+// reported with the error message from HASS.
+func sendCommandResult[T any](
+	ctx context.Context,
+	c *hassClient,
+	cmd hassmessage.Command,
+) (result T, err error) {
+	msg, err := c.sendCommand(ctx, cmd)
+	if err != nil {
+		if err == errCommandFailed {
+			return result, fmt.Errorf("%w: %s", err, msg.Error.Message)
+		}
+
+		return result, err
+	}
+
+	return result, msg.DecodeResult(&result)
+}
+
+// entityRegistryEntry returns the entity registry entry of entityID.
+func (c *hassClient) entityRegistryEntry(
+	ctx context.Context,
+	entityID string,
+) (hassmessage.EntityRegistryEntry, error) {
+	return sendCommandResult[hassmessage.EntityRegistryEntry](ctx, c, hassmessage.Command{
+		Type:     hassmessage.TypeEntityRegistryGet,
+		EntityID: entityID,
+	})
+}
+
+// browseMedia browses the media of the `media_player` entity, the root of its media browser is
+// returned if contentID and contentType are empty.
+func (c *hassClient) browseMedia(
+	ctx context.Context,
+	entityID, contentID, contentType string,
+) (hassmessage.BrowseMedia, error) {
+	return sendCommandResult[hassmessage.BrowseMedia](ctx, c, hassmessage.Command{
+		Type:             hassmessage.TypeBrowseMedia,
+		EntityID:         entityID,
+		MediaContentID:   contentID,
+		MediaContentType: contentType,
+	})
+}
+
+// subscribeCommand sends the subscription command with sub's receiver for its events on the
+// current session. c.subscriptionsMux must already be locked.
+func (c *hassClient) subscribeCommand(sub *subscription) error {
+	sess, id, msg, err := c.sendCommandTo(c.ctx, sub.cmd, sub.events)
+	if err != nil {
+		if err == errCommandFailed {
+			log.Error("command failed", "message", msg.Error.Message)
+		}
+
+		return err
+	}
+
+	sub.sess, sub.id = sess, id
+
+	return nil
+}
+
+// addSubscription sends the subscription command and keeps it to be renewed after reconnect.
+func (c *hassClient) addSubscription(cmd hassmessage.Command) (*subscription, error) {
+	sub := &subscription{cmd: cmd, events: newEventQueue(c.ctx)}
+
+	c.subscriptionsMux.Lock()
+	defer c.subscriptionsMux.Unlock()
+
+	if err := c.subscribeCommand(sub); err != nil {
+		sub.events.stop()
+		return nil, err
+	}
+
+	c.subscriptions = append(c.subscriptions, sub)
+
+	return sub, nil
+}
+
+// removeSubscription stops delivering the events of the subscription and sends
+// `unsubscribe_events`, the subscription will no longer be renewed after reconnect.
+func (c *hassClient) removeSubscription(sub *subscription) error {
+	c.subscriptionsMux.Lock()
+	n := len(c.subscriptions)
+	c.subscriptions = slices.DeleteFunc(c.subscriptions, func(s *subscription) bool {
+		return s == sub
+	})
+	removed, sess, id := n != len(c.subscriptions), sub.sess, sub.id
+	c.subscriptionsMux.Unlock()
+
+	if !removed {
+		return nil
+	}
+
+	sess.release(id)
+	sub.events.stop()
+
+	if sess != c.getSession() {
+		// the subscription has ended with its session
+		return nil
+	}
+
+	msg, err := c.sendCommand(c.ctx, hassmessage.Command{
+		Type:         hassmessage.TypeUnsubscribeEvents,
+		Subscription: id,
 	})
 	if err != nil {
 		if err == errCommandFailed {
-			log.Error("command failed", "message", msg.Result)
+			return fmt.Errorf("%w: %s", err, msg.Error.Message)
 		}
 
+		return err
+	}
+
+	return nil
+}
+
+// subscribeEntities subscribes to the compressed state changes of entityIDs, the events should
+// be applied to a [hassmessage.StateCache]. The first event contains the full states.
+func (c *hassClient) subscribeEntities(entityIDs []string) (<-chan hassmessage.Message, error) {
+	sub, err := c.addSubscription(hassmessage.Command{
+		Type:      hassmessage.TypeSubscribeEntities,
+		EntityIDs: entityIDs,
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	c.receiversMux.Lock()
-	defer c.receiversMux.Unlock()
+	log.Info("subscribe to HASS entities", "entities", entityIDs)
+
+	return sub.events.messages(), nil
+}
+
+// resubscribe renews every subscription on the current connection, the events will be delivered
+// to the same receiver as before.
+func (c *hassClient) resubscribe() error {
+	c.subscriptionsMux.Lock()
+	defer c.subscriptionsMux.Unlock()
 
-	log.Info("subscribe to HASS event", "event", evtType)
+	for _, sub := range c.subscriptions {
+		if err := c.subscribeCommand(sub); err != nil {
+			return err
+		}
 
-	return c.receivers[id], nil
+		log.Info("renewed subscription", "type", sub.cmd.Type, "event", sub.cmd.EventType)
+	}
+
+	return nil
 }
 
 func (c *hassClient) close() {
-	if err := c.conn.Close(websocket.StatusNormalClosure, "goodbye"); err != nil {
+	c.closed.Store(true)
+
+	if err := c.getSession().conn.Close(websocket.StatusNormalClosure, "goodbye"); err != nil {
 		log.Error("HASS websocket close failed", "err", err)
 	} else {
 		log.Info("closed HASS websocket connection")
 	}
 }
 
-func newHASSClient(ctx context.Context) *hassClient {
+func newHASSClient(
+	ctx context.Context,
+	httpClient *http.Client,
+	commandTimeout time.Duration,
+	maxMissedPongs int,
+) *hassClient {
 	return &hassClient{
-		ctx:       ctx,
-		receivers: make(map[uint64]chan hassmessage.Message),
+		ctx:            ctx,
+		httpClient:     httpClient,
+		commandTimeout: commandTimeout,
+		maxMissedPongs: maxMissedPongs,
+		states:         make(chan connState),
 	}
 }
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linnovs/hass-mpris-bridge/internal/hassmessage"
+)
+
+func TestClientAuthInvalid(t *testing.T) {
+	f := newFakeHASS(t)
+	client := newHASSClient(context.Background(), f.Client(), time.Second, 2)
+
+	err := client.connect(f.uri(), "wrong-token", make(chan error, 1))
+	if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Fatalf("connect with invalid token: got error %v, want authentication failed", err)
+	}
+}
+
+func TestClientSendCommand(t *testing.T) {
+	f := newFakeHASS(t)
+	f.setStates(
+		mediaPlayerState("media_player.kitchen", "playing", map[string]any{"media_title": "Song"}),
+	)
+	client, _ := newTestClient(t, f)
+
+	states, err := sendCommandResult[[]hassmessage.State](
+		context.Background(), client, hassmessage.Command{Type: hassmessage.TypeGetStates},
+	)
+	if err != nil {
+		t.Fatalf("get_states: %v", err)
+	}
+
+	if len(states) != 1 || states[0].EntityID != "media_player.kitchen" {
+		t.Fatalf("get_states: got %+v, want media_player.kitchen", states)
+	}
+
+	if got := states[0].Title(); got != "Song" {
+		t.Errorf("media_title: got %q, want %q", got, "Song")
+	}
+
+	cmds := f.commands(0, hassmessage.TypeGetStates)
+	if len(cmds) != 1 {
+		t.Fatalf("get_states commands received: got %d, want 1", len(cmds))
+	}
+
+	var last uint64
+	for _, cmd := range f.commands(0, "") {
+		if cmd.ID <= last {
+			t.Errorf("message ID %d after %d, want increasing IDs", cmd.ID, last)
+		}
+
+		last = cmd.ID
+	}
+}
+
+func TestClientCommandFailed(t *testing.T) {
+	f := newFakeHASS(t)
+	f.fail(hassmessage.TypeGetStates, "unknown_error", "Something went wrong")
+	client, _ := newTestClient(t, f)
+
+	_, err := sendCommandResult[[]hassmessage.State](
+		context.Background(), client, hassmessage.Command{Type: hassmessage.TypeGetStates},
+	)
+	if !errors.Is(err, errCommandFailed) {
+		t.Fatalf("failed command: got error %v, want %v", err, errCommandFailed)
+	}
+
+	if !strings.Contains(err.Error(), "Something went wrong") {
+		t.Errorf("failed command: error %q does not contain the HASS error message", err)
+	}
+}
+
+func TestClientCommandTimeout(t *testing.T) {
+	f := newFakeHASS(t)
+	f.ignore(hassmessage.TypeGetStates)
+	client, _ := newTestClient(t, f)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := client.sendCommand(ctx, hassmessage.Command{Type: hassmessage.TypeGetStates})
+	if !errors.Is(err, errCommandTimeout) {
+		t.Fatalf("unanswered command: got error %v, want %v", err, errCommandTimeout)
+	}
+}
+
+func TestClientConnectionLost(t *testing.T) {
+	f := newFakeHASS(t)
+	f.ignore(hassmessage.TypeGetStates)
+	client, errc := newTestClient(t, f)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.sendCommand(
+			context.Background(), hassmessage.Command{Type: hassmessage.TypeGetStates},
+		)
+		result <- err
+	}()
+
+	waitCommand(t, f, 0, hassmessage.TypeGetStates)
+	f.drop(0)
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, errConnectionLost) {
+			t.Fatalf("pending command: got error %v, want %v", err, errConnectionLost)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("pending command not failed after connection lost")
+	}
+
+	waitConnState(t, client, errc, connStateDisconnected)
+	waitConnState(t, client, errc, connStateReconnected)
+}
+
+func TestClientSubscribeEvent(t *testing.T) {
+	f := newFakeHASS(t)
+	client, _ := newTestClient(t, f)
+
+	sub, err := subscribeEvent[hassmessage.MediaPlayerData](
+		client, hassmessage.EventStateChanged, func(entityID string) bool {
+			return entityID == "media_player.kitchen"
+		},
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	f.stateChanged(0, "media_player.bedroom", mediaPlayerState("media_player.bedroom", "paused", nil))
+	f.stateChanged(0, "media_player.kitchen", mediaPlayerState("media_player.kitchen", "playing", nil))
+
+	data := waitEvent(t, sub)
+	if data.EntityID != "media_player.kitchen" || data.State.State != "playing" {
+		t.Fatalf("event data: got %+v, want media_player.kitchen playing", data)
+	}
+
+	select {
+	case data := <-sub.events():
+		t.Fatalf("unexpected event delivered: %+v", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClientUnsubscribe(t *testing.T) {
+	f := newFakeHASS(t)
+	client, _ := newTestClient(t, f)
+
+	sub, err := subscribeEvent[hassmessage.MediaPlayerData](
+		client, hassmessage.EventStateChanged, nil,
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	ids := f.subscriptions(0, hassmessage.EventStateChanged)
+	if len(ids) != 1 {
+		t.Fatalf("subscriptions on server: got %v, want 1", ids)
+	}
+
+	if err := sub.unsubscribe(); err != nil {
+		t.Fatalf("unsubscribe: %v", err)
+	}
+
+	cmds := f.commands(0, hassmessage.TypeUnsubscribeEvents)
+	if len(cmds) != 1 || cmds[0].Subscription != ids[0] {
+		t.Fatalf("unsubscribe_events: got %+v, want subscription %d", cmds, ids[0])
+	}
+
+	if ids := f.subscriptions(0, hassmessage.EventStateChanged); len(ids) != 0 {
+		t.Errorf("subscriptions on server after unsubscribe: got %v, want none", ids)
+	}
+
+	client.subscriptionsMux.Lock()
+	n := len(client.subscriptions)
+	client.subscriptionsMux.Unlock()
+
+	if n != 0 {
+		t.Errorf("subscriptions renewed after reconnect: got %d, want none", n)
+	}
+}
+
+func TestClientEventBurst(t *testing.T) {
+	f := newFakeHASS(t)
+	client, _ := newTestClient(t, f)
+
+	sub, err := client.addSubscription(hassmessage.Command{
+		Type:      hassmessage.TypeCommandSubscribeEvent,
+		EventType: hassmessage.EventStateChanged,
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	// more events than buffered, none of them read while the command is waiting for its result
+	n := 4 * subscriptionBufferSize
+	for i := range n {
+		f.stateChanged(0, fmt.Sprintf("media_player.p%d", i), nil)
+	}
+
+	_, err = client.sendCommand(
+		context.Background(), hassmessage.Command{Type: hassmessage.TypeGetStates},
+	)
+	if err != nil {
+		t.Fatalf("command during event burst: %v", err)
+	}
+
+	for i := range n {
+		var entity eventEntity
+
+		select {
+		case msg := <-sub.events.messages():
+			if err := json.Unmarshal(msg.Event.Data, &entity); err != nil {
+				t.Fatalf("unmarshal event: %v", err)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("event %d not delivered", i)
+		}
+
+		if want := fmt.Sprintf("media_player.p%d", i); entity.EntityID != want {
+			t.Fatalf("event %d: got %s, want %s", i, entity.EntityID, want)
+		}
+	}
+}
+
+func TestClientResubscribeAfterReconnect(t *testing.T) {
+	f := newFakeHASS(t)
+	client, errc := newTestClient(t, f)
+
+	sub, err := subscribeEvent[hassmessage.MediaPlayerData](
+		client, hassmessage.EventStateChanged, nil,
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	f.drop(0)
+	waitConnState(t, client, errc, connStateDisconnected)
+	waitConnState(t, client, errc, connStateReconnected)
+
+	f.stateChanged(1, "media_player.kitchen", mediaPlayerState("media_player.kitchen", "idle", nil))
+
+	if data := waitEvent(t, sub); data.EntityID != "media_player.kitchen" {
+		t.Fatalf("event data after reconnect: got %+v, want media_player.kitchen", data)
+	}
+}
+
+func TestClientIDReuse(t *testing.T) {
+	for name, reply := range map[string]map[string]any{
+		"result": {
+			"type":    hassmessage.TypeResult,
+			"success": false,
+			"error": map[string]any{
+				"code":    hassmessage.ErrorCodeIDReuse,
+				"message": "Identifier values have to increase.",
+			},
+		},
+		"message": {"type": hassmessage.TypeReuseID},
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := newFakeHASS(t)
+			f.queueReply(hassmessage.TypeGetStates, reply)
+			client, errc := newTestClient(t, f)
+
+			sub, err := client.addSubscription(hassmessage.Command{
+				Type:      hassmessage.TypeCommandSubscribeEvent,
+				EventType: hassmessage.EventStateChanged,
+			})
+			if err != nil {
+				t.Fatalf("subscribe: %v", err)
+			}
+
+			ctx := context.Background()
+
+			_, err = client.sendCommand(ctx, hassmessage.Command{Type: hassmessage.TypeGetStates})
+			if !errors.Is(err, errConnectionLost) {
+				t.Fatalf("command with reused ID: got error %v, want %v", err, errConnectionLost)
+			}
+
+			waitConnState(t, client, errc, connStateDisconnected)
+			waitConnState(t, client, errc, connStateReconnected)
+
+			cmds := f.commands(1, "")
+			if len(cmds) == 0 || cmds[0].Type != hassmessage.TypeCommandSubscribeEvent {
+				t.Fatalf("subscription not replayed on the new session, got %+v", cmds)
+			}
+
+			if cmds[0].ID != 1 {
+				t.Errorf("message ID on the new session: got %d, want 1", cmds[0].ID)
+			}
+
+			f.stateChanged(1, "media_player.kitchen", nil)
+
+			select {
+			case msg := <-sub.events.messages():
+				if msg.Event.EventType != hassmessage.EventStateChanged {
+					t.Errorf("event type: got %q, want %q",
+						msg.Event.EventType, hassmessage.EventStateChanged)
+				}
+			case <-time.After(testTimeout):
+				t.Fatal("event not delivered to the replayed subscription")
+			}
+
+			_, err = client.sendCommand(ctx, hassmessage.Command{Type: hassmessage.TypeGetStates})
+			if err != nil {
+				t.Errorf("command on the new session: %v", err)
+			}
+		})
+	}
+}
+
+// waitCommand waits for the nth session of the fake server to receive a command of the type.
+func waitCommand(t *testing.T, f *fakeHASS, n int, typ hassmessage.MessageType) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for len(f.commands(n, typ)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("command %q not received", typ)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitEvent waits for the next event delivered by the subscription.
+func waitEvent[T any](t *testing.T, sub *eventSubscription[T]) T {
+	t.Helper()
+
+	select {
+	case data := <-sub.events():
+		return data
+	case <-time.After(testTimeout):
+		t.Fatal("event not delivered")
+	}
+
+	var zero T
+
+	return zero
+}
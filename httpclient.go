@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+const (
+	headerAuthorization = "authorization"
+	bearerTokenFmt      = "Bearer %s"
+)
+
+var errNoCertificate = errors.New("no certificate found")
+
+// hassHTTP is the HTTP client shared by the websocket, REST API and artwork requests, the
+// bearer token is only sent to the HASS origin.
+type hassHTTP struct {
+	baseURL *url.URL
+	token   string
+	client  *http.Client
+}
+
+// get sends a GET request to ref resolved against the HASS base URL.
+func (h *hassHTTP) get(ctx context.Context, ref string) (*http.Response, error) {
+	u, err := h.baseURL.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == h.baseURL.Scheme && u.Host == h.baseURL.Host {
+		req.Header.Set(headerAuthorization, fmt.Sprintf(bearerTokenFmt, h.token))
+	}
+
+	return h.client.Do(req)
+}
+
+// httpBaseURL maps the websocket URI to the HASS origin, i.e., `ws://` to `http://` and
+// `wss://` to `https://`.
+func httpBaseURL(uri string) (*url.URL, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "https"
+	if u.Scheme == "ws" {
+		scheme = "http"
+	}
+
+	return &url.URL{Scheme: scheme, Host: u.Host}, nil
+}
+
+// tlsConfig returns the TLS configuration with the custom CA bundle and client certificate.
+func tlsConfig(cfg connectionConfig) (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify, //nolint:gosec // opt-in by user
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("connection.ca_file: %w", err)
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("connection.ca_file: %s: %w", cfg.CAFile, errNoCertificate)
+		}
+
+		conf.RootCAs = pool
+	}
+
+	if cfg.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("connection.client_cert: %w", err)
+		}
+
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
+
+func newHASSHTTP(cfg connectionConfig) (*hassHTTP, error) {
+	baseURL, err := httpBaseURL(cfg.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	conf, err := tlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		transport = &http.Transport{}
+	}
+
+	transport = transport.Clone()
+	transport.TLSClientConfig = conf
+
+	return &hassHTTP{
+		baseURL: baseURL,
+		token:   cfg.Token,
+		client:  &http.Client{Transport: transport, Timeout: cfg.Timeout.Duration},
+	}, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+	"github.com/linnovs/hass-mpris-bridge/internal/hassmessage"
+)
+
+// objectIDHashSize is the bytes of the entity ID hash appended to a sanitized object ID.
+const objectIDHashSize = 4
+
+var errNameTaken = errors.New("D-bus name already taken")
+
+// instance is the D-bus object implementing `org.mpris.MediaPlayer2` for a single HASS
+// `media_player` entity, every instance own a private D-bus connection and bus name.
+type instance struct {
+	conn       *dbus.Conn
+	name       string
+	identity   string
+	player     *player
+	trackList  *trackList
+	playlists  *playlists
+	propsSpec  map[string]*prop.Prop
+	properties *prop.Properties
+	updatedAt  time.Time // last_updated of the latest applied state
+	artMux     sync.Mutex
+	artPath    string             // entity_picture of the current track
+	artURL     string             // cached file URL of artPath, empty while downloading
+	artCancel  context.CancelFunc // cancels the in-flight download of artPath
+}
+
+// Raise do nothing.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Media_Player.html#Method:Raise
+func (i *instance) Raise() *dbus.Error {
+	return nil
+}
+
+// Quit do nothing.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Media_Player.html#Method:Quit
+func (i *instance) Quit() *dbus.Error {
+	return nil
+}
+
+func (i *instance) props() map[string]*prop.Prop {
+	if i.propsSpec != nil {
+		return i.propsSpec
+	}
+
+	i.propsSpec = map[string]*prop.Prop{
+		"CanQuit":          {Value: false, Writable: false, Emit: prop.EmitTrue},
+		"Fullscreen":       {Value: false, Writable: false, Emit: prop.EmitTrue},
+		"CanSetFullscreen": {Value: false, Writable: false, Emit: prop.EmitTrue},
+		"CanRaise":         {Value: false, Writable: false, Emit: prop.EmitTrue},
+		"HasTrackList":     {Value: false, Writable: false, Emit: prop.EmitTrue},
+		"Identity":         {Value: i.identity, Writable: false, Emit: prop.EmitTrue},
+		"DesktopEntry":     {Value: desktopEntry, Writable: false, Emit: prop.EmitTrue},
+		"SupportedUriSchemes": {
+			Value: i.player.supportedURISchemes(), Writable: false, Emit: prop.EmitTrue,
+		},
+		"SupportedMimeTypes": {
+			Value: i.player.supportedMimeTypes(), Writable: false, Emit: prop.EmitTrue,
+		},
+	}
+
+	return i.propsSpec
+}
+
+func (i *instance) export() (ifaces []introspect.Interface, err error) {
+	if err := i.conn.Export(i, dbusObjectPath, dbusObjectIface); err != nil {
+		return nil, err
+	}
+
+	err = i.conn.ExportWithMap(i.player, playerMethods, dbusObjectPath, dbusPlayerIface)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := i.conn.Export(i.trackList, dbusObjectPath, dbusTrackListIface); err != nil {
+		return nil, err
+	}
+
+	if err := i.conn.Export(i.playlists, dbusObjectPath, dbusPlaylistsIface); err != nil {
+		return nil, err
+	}
+
+	props, err := prop.Export(i.conn, dbusObjectPath, map[string]map[string]*prop.Prop{
+		dbusObjectIface:    i.props(),
+		dbusPlayerIface:    i.player.props(),
+		dbusTrackListIface: i.trackList.props(),
+		dbusPlaylistsIface: i.playlists.props(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = i.conn.Export(
+		&properties{Properties: props, player: i.player},
+		dbusObjectPath,
+		dbusPropertiesIface,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	objIface := introspect.Interface{Name: dbusObjectIface}
+	objIface.Methods = introspect.Methods(i)
+	objIface.Properties = props.Introspection(dbusObjectIface)
+
+	plyIface := introspect.Interface{Name: dbusPlayerIface}
+	plyIface.Methods = introspect.Methods(i.player)
+	for n, m := range plyIface.Methods {
+		if name, ok := playerMethods[m.Name]; ok {
+			plyIface.Methods[n].Name = name
+		}
+	}
+	plyIface.Properties = props.Introspection(dbusPlayerIface)
+	plyIface.Signals = []introspect.Signal{{
+		Name: "Seeked",
+		Args: []introspect.Arg{{Name: "Position", Type: "x", Direction: "out"}},
+	}}
+
+	tlIface := introspect.Interface{Name: dbusTrackListIface}
+	tlIface.Methods = introspect.Methods(i.trackList)
+	tlIface.Properties = props.Introspection(dbusTrackListIface)
+	tlIface.Signals = []introspect.Signal{{
+		Name: "TrackListReplaced",
+		Args: []introspect.Arg{
+			{Name: "Tracks", Type: "ao", Direction: "out"},
+			{Name: "CurrentTrack", Type: "o", Direction: "out"},
+		},
+	}}
+
+	plIface := introspect.Interface{Name: dbusPlaylistsIface}
+	plIface.Methods = introspect.Methods(i.playlists)
+	plIface.Properties = props.Introspection(dbusPlaylistsIface)
+	plIface.Signals = []introspect.Signal{{
+		Name: "PlaylistChanged",
+		Args: []introspect.Arg{{Name: "Playlist", Type: "(oss)", Direction: "out"}},
+	}}
+
+	i.properties = props
+	i.player.properties = props
+
+	return []introspect.Interface{objIface, plyIface, tlIface, plIface}, nil
+}
+
+func (i *instance) connect() (err error) {
+	reply, err := i.conn.RequestName(i.name, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return err
+	}
+
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return errNameTaken
+	}
+
+	ifaces, err := i.export()
+	if err != nil {
+		return err
+	}
+
+	n := introspect.NewIntrospectable(&introspect.Node{
+		Name: dbusObjectPath,
+		Interfaces: append(
+			[]introspect.Interface{introspect.IntrospectData, prop.IntrospectData},
+			ifaces...,
+		),
+	})
+
+	if err := i.conn.Export(n, dbusObjectPath, introspect.IntrospectData.Name); err != nil {
+		return err
+	}
+
+	log.Info("exported D-bus /org/mpris/MediaPlayer2", "name", i.name)
+
+	return nil
+}
+
+func (i *instance) close() {
+	i.artMux.Lock()
+	if i.artCancel != nil {
+		i.artCancel()
+	}
+	i.artMux.Unlock()
+
+	// wait for the properties being published by the background goroutines
+	i.player.closeMux.Lock()
+	i.player.closed = true
+	i.player.closeMux.Unlock()
+
+	if err := i.conn.Close(); err != nil {
+		log.Error("D-bus connection close failed", "name", i.name, "err", err)
+	} else {
+		log.Info("disconnect from D-bus", "name", i.name)
+	}
+}
+
+// busName returns the D-bus name for entityID, every character not allowed in a D-bus name
+// element will be replaced by underscore.
+func busName(entityID string) string {
+	return fmt.Sprintf(dbusNameFormat, objectID(entityID))
+}
+
+// objectID returns the entity's object ID sanitized to be used in D-Bus names and paths, a short
+// hash of the entity ID is appended if any character is replaced, so the entities which only
+// differ in the replaced characters, e.g., `a-b` and `a_b`, don't share the same bus name.
+func objectID(entityID string) string {
+	id := strings.TrimPrefix(entityID, hassmessage.MediaPlayerPrefix)
+
+	sanitized := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, id)
+
+	if sanitized != id {
+		sum := sha256.Sum256([]byte(entityID))
+		sanitized = fmt.Sprintf("%s_%x", sanitized, sum[:objectIDHashSize])
+	}
+
+	if sanitized == "" || (sanitized[0] >= '0' && sanitized[0] <= '9') {
+		sanitized = "_" + sanitized
+	}
+
+	return sanitized
+}
+
+func newInstance(
+	ctx context.Context,
+	client *hassClient,
+	entityID, identity string,
+	uriSchemes map[string]string,
+) (*instance, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, err
+	}
+
+	i := &instance{
+		conn:     conn,
+		name:     busName(entityID),
+		identity: identity,
+		player: &player{
+			ctx:        ctx,
+			client:     client,
+			conn:       conn,
+			entityID:   entityID,
+			uriSchemes: uriSchemes,
+		},
+	}
+	i.trackList = &trackList{player: i.player}
+	i.playlists = &playlists{player: i.player}
+
+	if err := i.connect(); err != nil {
+		i.close()
+		return nil, err
+	}
+
+	return i, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestObjectID(t *testing.T) {
+	tests := map[string]string{
+		"media_player.kitchen":   "kitchen",
+		"media_player.2nd_floor": "_2nd_floor",
+	}
+
+	for entityID, want := range tests {
+		if got := objectID(entityID); got != want {
+			t.Errorf("objectID(%q): got %q, want %q", entityID, got, want)
+		}
+	}
+
+	ids := map[string]string{}
+
+	for _, entityID := range []string{"media_player.a_b", "media_player.a-b", "media_player.a.b"} {
+		id := objectID(entityID)
+		if other, ok := ids[id]; ok {
+			t.Errorf("objectID(%q): %q is the same as %q", entityID, id, other)
+		}
+
+		ids[id] = entityID
+	}
+}
@@ -0,0 +1,20 @@
+package hassmessage
+
+// `media_class` of [BrowseMedia].
+const (
+	MediaClassDirectory = "directory"
+	MediaClassPlaylist  = "playlist"
+)
+
+// BrowseMedia is the result of `media_player/browse_media` command, the children are only
+// populated for the browsed item itself.
+type BrowseMedia struct {
+	Title            string        `json:"title"`
+	MediaClass       string        `json:"media_class"`
+	MediaContentID   string        `json:"media_content_id"`
+	MediaContentType string        `json:"media_content_type"`
+	CanPlay          bool          `json:"can_play"`
+	CanExpand        bool          `json:"can_expand"`
+	Thumbnail        string        `json:"thumbnail"`
+	Children         []BrowseMedia `json:"children"`
+}
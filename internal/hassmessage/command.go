@@ -6,6 +6,8 @@ type EventType string
 const (
 	// EventStateChanged represent the `state_changed` event bus.
 	EventStateChanged EventType = "state_changed"
+	// EventEntityRegistryUpdated represent the `entity_registry_updated` event bus.
+	EventEntityRegistryUpdated EventType = "entity_registry_updated"
 )
 
 // ServiceType represent call_service's servic action name
@@ -22,6 +24,26 @@ const (
 	ServiceSeek      ServiceType = "media_seek"
 	ServiceShuffle   ServiceType = "shuffle_set"
 	ServiceRepeat    ServiceType = "repeat_set"
+	ServicePlayMedia ServiceType = "play_media"
+
+	// ServiceGetQueue returns the queue of a Sonos or Music Assistant player as the response.
+	ServiceGetQueue        ServiceType = "get_queue"
+	ServicePlayQueue       ServiceType = "play_queue"
+	ServiceRemoveFromQueue ServiceType = "remove_from_queue"
+)
+
+// Enqueue modes for `play_media` service data.
+const (
+	EnqueuePlay = "play"
+	EnqueueNext = "next"
+	EnqueueAdd  = "add"
+)
+
+// Repeat modes for `repeat_set` service data and `repeat` attribute.
+const (
+	RepeatModeOff = "off"
+	RepeatModeOne = "one"
+	RepeatModeAll = "all"
 )
 
 // ServiceDomain is the domain for a command.
@@ -30,15 +52,23 @@ type ServiceDomain string
 const (
 	// DomainMediaPlayer is the media_player domain
 	DomainMediaPlayer ServiceDomain = "media_player"
+	// DomainSonos is the sonos integration domain
+	DomainSonos ServiceDomain = "sonos"
+	// DomainMusicAssistant is the music_assistant integration domain
+	DomainMusicAssistant ServiceDomain = "music_assistant"
 )
 
 // CommandData represent the `service_data` in calling a service.
 type CommandData struct {
-	IsMuted      *bool   `json:"is_volume_muted,omitempty"`
-	VolumeLevel  float64 `json:"volume_level,omitempty"`
-	SeekPosition int     `json:"seek_position,omitempty"`
-	Shuffle      *bool   `json:"shuffle,omitempty"`
-	RepeatMode   string  `json:"repeat,omitempty"`
+	IsMuted       *bool    `json:"is_volume_muted,omitempty"`
+	VolumeLevel   *float64 `json:"volume_level,omitempty"`
+	SeekPosition  *float64 `json:"seek_position,omitempty"` // in seconds
+	Shuffle       *bool    `json:"shuffle,omitempty"`
+	RepeatMode    string   `json:"repeat,omitempty"`
+	ContentID     string   `json:"media_content_id,omitempty"`
+	ContentType   string   `json:"media_content_type,omitempty"`
+	Enqueue       string   `json:"enqueue,omitempty"`
+	QueuePosition *int     `json:"queue_position,omitempty"`
 }
 
 // Target represent the `target` in calling a service.
@@ -58,4 +88,11 @@ type Command struct {
 	Target         *Target       `json:"target,omitempty"`
 	ReturnResponse *bool         `json:"return_response,omitempty"`
 	EventType      EventType     `json:"event_type,omitempty"`
+	EntityIDs      []string      `json:"entity_ids,omitempty"`
+	EntityID       string        `json:"entity_id,omitempty"`
+	Subscription   uint64        `json:"subscription,omitempty"` // `unsubscribe_events` only
+
+	// `media_player/browse_media` command only
+	MediaContentID   string `json:"media_content_id,omitempty"`
+	MediaContentType string `json:"media_content_type,omitempty"`
 }
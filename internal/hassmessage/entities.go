@@ -0,0 +1,119 @@
+package hassmessage
+
+import (
+	"encoding/json"
+	"maps"
+	"math"
+	"sync"
+	"time"
+)
+
+// CompressedState is the compact state sent by `subscribe_entities` for added entities and
+// the changed part of a [CompressedDiff].
+type CompressedState struct {
+	State       *string                    `json:"s"`
+	Attributes  map[string]json.RawMessage `json:"a"`
+	LastChanged float64                    `json:"lc"`
+	LastUpdated float64                    `json:"lu"`
+}
+
+// CompressedDiff is the changes of an entity sent by `subscribe_entities`.
+type CompressedDiff struct {
+	Additions *CompressedState `json:"+"`
+	Removals  *struct {
+		Attributes []string `json:"a"`
+	} `json:"-"`
+}
+
+// entity is a cached entity state with decoded attributes so diffs can be merged.
+type entity struct {
+	state       string
+	attributes  map[string]json.RawMessage
+	lastUpdated time.Time
+}
+
+// StateCache keeps the entity states received from `subscribe_entities` and applies the
+// compressed diffs to them.
+type StateCache struct {
+	mux      sync.Mutex
+	entities map[string]*entity
+}
+
+// Apply applies the added, changed and removed entities of evt to the cache, it returns the
+// full states of every added or changed entity and the IDs of removed entities.
+func (c *StateCache) Apply(evt Event) (changed []State, removed []string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.entities == nil {
+		c.entities = make(map[string]*entity)
+	}
+
+	for entityID, added := range evt.Added {
+		e := &entity{attributes: make(map[string]json.RawMessage)}
+		e.merge(added)
+		c.entities[entityID] = e
+		changed = append(changed, e.toState(entityID))
+	}
+
+	for entityID, diff := range evt.Changed {
+		e, ok := c.entities[entityID]
+		if !ok {
+			continue
+		}
+
+		if diff.Additions != nil {
+			e.merge(*diff.Additions)
+		}
+
+		if diff.Removals != nil {
+			for _, key := range diff.Removals.Attributes {
+				delete(e.attributes, key)
+			}
+		}
+
+		changed = append(changed, e.toState(entityID))
+	}
+
+	for _, entityID := range evt.Removed {
+		delete(c.entities, entityID)
+		removed = append(removed, entityID)
+	}
+
+	return changed, removed
+}
+
+func (e *entity) merge(s CompressedState) {
+	if s.State != nil {
+		e.state = *s.State
+	}
+
+	maps.Copy(e.attributes, s.Attributes)
+
+	switch {
+	case s.LastUpdated != 0:
+		e.lastUpdated = unixTime(s.LastUpdated)
+	case s.LastChanged != 0:
+		e.lastUpdated = unixTime(s.LastChanged)
+	}
+}
+
+func (e *entity) toState(entityID string) State {
+	attrs, err := json.Marshal(e.attributes)
+	if err != nil {
+		attrs = []byte("{}")
+	}
+
+	return State{
+		EntityID:    entityID,
+		State:       e.state,
+		Attributes:  attrs,
+		LastUpdated: e.lastUpdated,
+	}
+}
+
+// unixTime converts the fractional UNIX timestamp used by compressed states.
+func unixTime(ts float64) time.Time {
+	sec, frac := math.Modf(ts)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second)))
+}
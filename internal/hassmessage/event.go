@@ -5,11 +5,24 @@ import (
 )
 
 type MediaPlayerData struct {
-	State State `json:"new_state"`
+	EntityID string `json:"entity_id"`
+	State    State  `json:"new_state"`
+}
+
+// EntityRegistryUpdatedData is the data of `entity_registry_updated` event.
+type EntityRegistryUpdatedData struct {
+	Action      string `json:"action"`
+	EntityID    string `json:"entity_id"`
+	OldEntityID string `json:"old_entity_id"`
 }
 
 // Event will sent by the server after the client sent the `subscribe_events` commands.
 type Event struct {
 	EventType EventType       `json:"event_type"`
 	Data      json.RawMessage `json:"data"`
+
+	// `subscribe_entities` command only
+	Added   map[string]CompressedState `json:"a"`
+	Changed map[string]CompressedDiff  `json:"c"`
+	Removed []string                   `json:"r"`
 }
@@ -24,12 +24,24 @@ const (
 	TypeReuseID MessageType = "id_reuse"
 	// TypeCommandSubscribeEvent is the command for client subscribe to event bus on the server.
 	TypeCommandSubscribeEvent MessageType = "subscribe_events"
+	// TypeUnsubscribeEvents is the command for client to stop a subscription.
+	TypeUnsubscribeEvents MessageType = "unsubscribe_events"
+	// TypeSubscribeEntities is the command for client to subscribe to compressed state changes of
+	// the entities.
+	TypeSubscribeEntities MessageType = "subscribe_entities"
 	// TypeCallService is the command for client to call a service action on the server.
 	TypeCallService MessageType = "call_service"
 	// TypeGetStates is the command for client to fetching states from the server.
 	TypeGetStates MessageType = "get_states"
+	// TypeEntityRegistryGet is the command for client to fetching an entity registry entry.
+	TypeEntityRegistryGet MessageType = "config/entity_registry/get"
+	// TypeBrowseMedia is the command for client to browse the media of a `media_player` entity.
+	TypeBrowseMedia MessageType = "media_player/browse_media"
 )
 
+// ErrorCodeIDReuse is the Result message type's error code when the same message id is used once.
+const ErrorCodeIDReuse = "id_reuse"
+
 // Error represent the Result message type's error field.
 type Error struct {
 	Code    string `json:"code"`
@@ -49,3 +61,8 @@ type Message struct {
 	// Event message type only
 	Event Event `json:"event"`
 }
+
+// DecodeResult decodes the result of Result message type into v.
+func (m *Message) DecodeResult(v any) error {
+	return json.Unmarshal(m.Result, v)
+}
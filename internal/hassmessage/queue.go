@@ -0,0 +1,133 @@
+package hassmessage
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var ErrNoQueue = errors.New("no queue in service response")
+
+// ServiceResult is the result of `call_service` command.
+type ServiceResult struct {
+	Response map[string]json.RawMessage `json:"response"`
+}
+
+// EntityRegistryEntry is the result of `config/entity_registry/get` command.
+type EntityRegistryEntry struct {
+	EntityID string `json:"entity_id"`
+	Platform string `json:"platform"`
+}
+
+// QueueItem is an item in the queue of a player.
+type QueueItem struct {
+	Title     string
+	Artist    string
+	Album     string
+	ContentID string
+	ImageURL  string
+	Duration  float64 // in seconds
+}
+
+// sonosQueueItem is an item of `sonos.get_queue` response.
+type sonosQueueItem struct {
+	Title     string `json:"media_title"`
+	Artist    string `json:"media_artist"`
+	Album     string `json:"media_album_name"`
+	ContentID string `json:"media_content_id"`
+}
+
+// ParseSonosQueue parses the `sonos.get_queue` response of entityID, the whole queue is returned.
+func ParseSonosQueue(entityID string, result ServiceResult) ([]QueueItem, error) {
+	raw, ok := result.Response[entityID]
+	if !ok {
+		return nil, ErrNoQueue
+	}
+
+	var items []sonosQueueItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, err
+	}
+
+	queue := make([]QueueItem, 0, len(items))
+	for _, item := range items {
+		queue = append(queue, QueueItem{
+			Title:     item.Title,
+			Artist:    item.Artist,
+			Album:     item.Album,
+			ContentID: item.ContentID,
+		})
+	}
+
+	return queue, nil
+}
+
+// maQueueItem is the `current_item` and `next_item` of `music_assistant.get_queue` response.
+type maQueueItem struct {
+	Duration  float64 `json:"duration"`
+	MediaItem struct {
+		URI   string `json:"uri"`
+		Name  string `json:"name"`
+		Image *struct {
+			Path string `json:"path"`
+		} `json:"image"`
+		Artists []struct {
+			Name string `json:"name"`
+		} `json:"artists"`
+		Album *struct {
+			Name string `json:"name"`
+		} `json:"album"`
+	} `json:"media_item"`
+}
+
+func (i *maQueueItem) queueItem() QueueItem {
+	artists := make([]string, 0, len(i.MediaItem.Artists))
+	for _, a := range i.MediaItem.Artists {
+		artists = append(artists, a.Name)
+	}
+
+	item := QueueItem{
+		Title:     i.MediaItem.Name,
+		Artist:    strings.Join(artists, ", "),
+		ContentID: i.MediaItem.URI,
+		Duration:  i.Duration,
+	}
+
+	if i.MediaItem.Album != nil {
+		item.Album = i.MediaItem.Album.Name
+	}
+
+	if i.MediaItem.Image != nil && strings.HasPrefix(i.MediaItem.Image.Path, "http") {
+		item.ImageURL = i.MediaItem.Image.Path
+	}
+
+	return item
+}
+
+// ParseMusicAssistantQueue parses the `music_assistant.get_queue` response of entityID, only the
+// current and next items are exposed by Music Assistant.
+func ParseMusicAssistantQueue(entityID string, result ServiceResult) ([]QueueItem, error) {
+	raw, ok := result.Response[entityID]
+	if !ok {
+		return nil, ErrNoQueue
+	}
+
+	var queue struct {
+		CurrentItem *maQueueItem `json:"current_item"`
+		NextItem    *maQueueItem `json:"next_item"`
+	}
+
+	if err := json.Unmarshal(raw, &queue); err != nil {
+		return nil, err
+	}
+
+	items := []QueueItem{}
+
+	for _, item := range []*maQueueItem{queue.CurrentItem, queue.NextItem} {
+		if item != nil {
+			items = append(items, item.queueItem())
+		}
+	}
+
+	return items, nil
+}
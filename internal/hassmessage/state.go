@@ -3,6 +3,7 @@ package hassmessage
 import (
 	"encoding/json"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/log"
 )
@@ -26,13 +27,29 @@ func (r MediaPlayerAttrRepeat) String() string {
 	}
 }
 
+// MediaPlayerAttrState is the playback state of a `media_player` entity. Idle means nothing is
+// loaded, Stopped keeps the current media and Unavailable means the player can't be controlled.
 type MediaPlayerAttrState int
 
 const (
-	MediaPlayerAttrStateIdle = 1 << iota
+	MediaPlayerAttrStateIdle MediaPlayerAttrState = 1 << iota
 	MediaPlayerAttrStatePlaying
 	MediaPlayerAttrStatePaused
 	MediaPlayerAttrStateStopped
+	MediaPlayerAttrStateUnavailable
+)
+
+// States reported by a `media_player` entity.
+const (
+	StateOff         = "off"
+	StateOn          = "on"
+	StateIdle        = "idle"
+	StatePlaying     = "playing"
+	StatePaused      = "paused"
+	StateStandby     = "standby"
+	StateBuffering   = "buffering"
+	StateUnavailable = "unavailable"
+	StateUnknown     = "unknown"
 )
 
 func (s MediaPlayerAttrState) String() string {
@@ -46,26 +63,117 @@ func (s MediaPlayerAttrState) String() string {
 	}
 }
 
+// MediaPlayerFeature is the `supported_features` bitmask of a `media_player` entity.
+// see: https://developers.home-assistant.io/docs/core/entity/media-player/#supported-features
+type MediaPlayerFeature int
+
+const (
+	MediaPlayerFeaturePause MediaPlayerFeature = 1 << iota
+	MediaPlayerFeatureSeek
+	MediaPlayerFeatureVolumeSet
+	MediaPlayerFeatureVolumeMute
+	MediaPlayerFeaturePreviousTrack
+	MediaPlayerFeatureNextTrack
+	_
+	MediaPlayerFeatureTurnOn
+	MediaPlayerFeatureTurnOff
+	MediaPlayerFeaturePlayMedia
+	MediaPlayerFeatureVolumeStep
+	MediaPlayerFeatureSelectSource
+	MediaPlayerFeatureStop
+	MediaPlayerFeatureClearPlaylist
+	MediaPlayerFeaturePlay
+	MediaPlayerFeatureShuffleSet
+	MediaPlayerFeatureSelectSoundMode
+	MediaPlayerFeatureBrowseMedia
+	MediaPlayerFeatureRepeatSet
+	MediaPlayerFeatureGrouping
+	MediaPlayerFeatureMediaAnnounce
+	MediaPlayerFeatureMediaEnqueue
+	MediaPlayerFeatureSearchMedia
+)
+
+// Has reports whether all of the features f are in the bitmask.
+func (m MediaPlayerFeature) Has(f MediaPlayerFeature) bool {
+	return m&f == f
+}
+
+// Media content types reported by `media_content_type` attribute.
+const (
+	MediaContentTypeMusic   = "music"
+	MediaContentTypePodcast = "podcast"
+	MediaContentTypeVideo   = "video"
+	MediaContentTypeMovie   = "movie"
+	MediaContentTypeTVShow  = "tvshow"
+	MediaContentTypeEpisode = "episode"
+	MediaContentTypeChannel = "channel"
+)
+
+// flexString decodes both JSON string and number as some integrations report e.g. the
+// season and episode number as number.
+type flexString string
+
+func (f *flexString) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+
+		*f = flexString(s)
+
+		return nil
+	}
+
+	if string(data) == "null" {
+		*f = ""
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+
+	*f = flexString(n)
+
+	return nil
+}
+
 type MediaPlayerAttributes struct {
-	ID          string  `json:"app_id"`
-	Name        string  `json:"app_name"`
-	Picture     string  `json:"entity_picture"`
-	Album       string  `json:"media_album_name"`
-	Artist      string  `json:"media_artist"`
-	Duration    int64   `json:"media_duration"`
-	Position    int64   `json:"media_position"`
-	Title       string  `json:"media_title"`
-	VolumeLevel float64 `json:"volume_level"`
-	Shuffle     bool    `json:"shuffle"`
-	Repeat      string  `json:"repeat"`
-	ContentType string  `json:"media_content_type"`
+	ID                string             `json:"app_id"`
+	Name              string             `json:"app_name"`
+	Picture           string             `json:"entity_picture"`
+	Album             string             `json:"media_album_name"`
+	AlbumArtist       string             `json:"media_album_artist"`
+	Artist            string             `json:"media_artist"`
+	Duration          float64            `json:"media_duration"`
+	Position          float64            `json:"media_position"`
+	PositionUpdatedAt time.Time          `json:"media_position_updated_at"`
+	Title             string             `json:"media_title"`
+	Track             flexString         `json:"media_track"`
+	ContentID         string             `json:"media_content_id"`
+	Playlist          string             `json:"media_playlist"`
+	QueuePosition     flexString         `json:"queue_position"`
+	QueueSize         flexString         `json:"queue_size"`
+	VolumeLevel       float64            `json:"volume_level"`
+	Shuffle           bool               `json:"shuffle"`
+	Repeat            string             `json:"repeat"`
+	ContentType       string             `json:"media_content_type"`
+	SeriesTitle       string             `json:"media_series_title"`
+	Season            flexString         `json:"media_season"`
+	Episode           flexString         `json:"media_episode"`
+	Channel           string             `json:"media_channel"`
+	FriendlyName      string             `json:"friendly_name"`
+	SupportedFeatures MediaPlayerFeature `json:"supported_features"`
 }
 
 type State struct {
-	EntityID   string          `json:"entity_id"`
-	State      string          `json:"state"`
-	Attributes json.RawMessage `json:"attributes"`
-	attrs      *MediaPlayerAttributes
+	EntityID    string          `json:"entity_id"`
+	State       string          `json:"state"`
+	Attributes  json.RawMessage `json:"attributes"`
+	LastUpdated time.Time       `json:"last_updated"`
+	attrs       *MediaPlayerAttributes
 }
 
 func (s *State) parseAttrs() {
@@ -78,26 +186,32 @@ func (s *State) parseAttrs() {
 	}
 }
 
-const mediaPlayerPrefix = "media_player."
+// MediaPlayerPrefix is the entity ID prefix of the `media_player` domain.
+const MediaPlayerPrefix = "media_player."
 
 func (s *State) IsMediaPlayer() bool {
-	return strings.HasPrefix(s.EntityID, mediaPlayerPrefix)
+	return strings.HasPrefix(s.EntityID, MediaPlayerPrefix)
 }
 
-func (s *State) IsMusicPlayer() bool {
+func (s *State) ContentType() string {
 	s.parseAttrs()
-	return s.attrs.ContentType == "music"
+	return s.attrs.ContentType
 }
 
+// PlaybackState maps the entity's state to the playback state, buffering is reported as playing
+// so the position keeps moving, and a player which is on without media is idle.
 func (s *State) PlaybackState() MediaPlayerAttrState {
 	switch s.State {
-	case "playing":
+	case StatePlaying, StateBuffering:
 		return MediaPlayerAttrStatePlaying
-	case "paused":
+	case StatePaused:
 		return MediaPlayerAttrStatePaused
-	case "standby":
-		return MediaPlayerAttrStateStopped
+	case StateOff, StateOn, StateIdle, StateStandby:
+		return MediaPlayerAttrStateIdle
+	case StateUnavailable, StateUnknown:
+		return MediaPlayerAttrStateUnavailable
 	default:
+		log.Debug("unknown media_player state", "entity", s.EntityID, "state", s.State)
 		return MediaPlayerAttrStateIdle
 	}
 }
@@ -105,9 +219,9 @@ func (s *State) PlaybackState() MediaPlayerAttrState {
 func (s *State) Repeat() MediaPlayerAttrRepeat {
 	s.parseAttrs()
 	switch s.attrs.Repeat {
-	case "all":
+	case RepeatModeAll:
 		return MediaPlayerAttrRepeatAll
-	case "one":
+	case RepeatModeOne:
 		return MediaPlayerAttrRepeatOne
 	default:
 		return MediaPlayerAttrRepeatOff
@@ -121,7 +235,7 @@ func (s *State) Shuffle() bool {
 
 func (s *State) Duration() int64 {
 	s.parseAttrs()
-	return s.attrs.Duration * 1000 * 1000 // convert to microseconds
+	return int64(s.attrs.Duration * 1000 * 1000) // convert to microseconds
 }
 
 func (s *State) ArtURL() string {
@@ -134,6 +248,11 @@ func (s *State) Album() string {
 	return s.attrs.Album
 }
 
+func (s *State) AlbumArtist() string {
+	s.parseAttrs()
+	return s.attrs.AlbumArtist
+}
+
 func (s *State) Artist() string {
 	s.parseAttrs()
 	return s.attrs.Artist
@@ -144,6 +263,63 @@ func (s *State) Title() string {
 	return s.attrs.Title
 }
 
+func (s *State) Track() string {
+	s.parseAttrs()
+	return string(s.attrs.Track)
+}
+
+func (s *State) ContentID() string {
+	s.parseAttrs()
+	return s.attrs.ContentID
+}
+
+func (s *State) Playlist() string {
+	s.parseAttrs()
+	return s.attrs.Playlist
+}
+
+// QueueKey returns the queue position and size reported by the player, which changes once the
+// player's queue is changed.
+func (s *State) QueueKey() string {
+	s.parseAttrs()
+	return string(s.attrs.QueuePosition) + "/" + string(s.attrs.QueueSize)
+}
+
+func (s *State) SeriesTitle() string {
+	s.parseAttrs()
+	return s.attrs.SeriesTitle
+}
+
+func (s *State) Season() string {
+	s.parseAttrs()
+	return string(s.attrs.Season)
+}
+
+func (s *State) Episode() string {
+	s.parseAttrs()
+	return string(s.attrs.Episode)
+}
+
+func (s *State) Channel() string {
+	s.parseAttrs()
+	return s.attrs.Channel
+}
+
+func (s *State) AppName() string {
+	s.parseAttrs()
+	return s.attrs.Name
+}
+
+func (s *State) FriendlyName() string {
+	s.parseAttrs()
+	return s.attrs.FriendlyName
+}
+
+func (s *State) SupportedFeatures() MediaPlayerFeature {
+	s.parseAttrs()
+	return s.attrs.SupportedFeatures
+}
+
 func (s *State) Volume() float64 {
 	s.parseAttrs()
 	return s.attrs.VolumeLevel
@@ -151,5 +327,11 @@ func (s *State) Volume() float64 {
 
 func (s *State) Position() int64 {
 	s.parseAttrs()
-	return s.attrs.Position * 1000 * 1000 // convert to microseconds
+	return int64(s.attrs.Position * 1000 * 1000) // convert to microseconds
+}
+
+// PositionUpdatedAt returns when the position was last reported, zero if it is unknown.
+func (s *State) PositionUpdatedAt() time.Time {
+	s.parseAttrs()
+	return s.attrs.PositionUpdatedAt
 }
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"os"
 	"os/signal"
 	"syscall"
@@ -11,13 +10,14 @@ import (
 	"github.com/linnovs/hass-mpris-bridge/internal/hassmessage"
 )
 
-const (
-	envkeyURI   = "HASS_URI"
-	envkeyToken = "HASS_TOKEN"
-)
-
 func main() {
-	if os.Getenv("DEBUG") == "true" {
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Error("load configuration failed", "err", err)
+		return
+	}
+
+	if cfg.Debug {
 		log.SetLevel(log.DebugLevel)
 	}
 
@@ -25,35 +25,80 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	client := newHASSClient(ctx)
-	if err := client.connect(os.Getenv(envkeyURI), os.Getenv(envkeyToken), errc); err != nil {
+	hassHTTP, err := newHASSHTTP(cfg.Connection)
+	if err != nil {
+		log.Error("create HTTP client failed", "err", err)
+		return
+	}
+
+	client := newHASSClient(
+		ctx,
+		hassHTTP.client,
+		cfg.Connection.CommandTimeout.Duration,
+		cfg.Connection.MaxMissedPongs,
+	)
+	if err := client.connect(cfg.Connection.URI, cfg.Connection.Token, errc); err != nil {
 		log.Error("connect to HASS websocket failed", "err", err)
 		return
 	}
 	defer client.close()
 
-	bdg, err := newBridge(ctx, client)
+	bdg, err := newBridge(ctx, client, hassHTTP, cfg)
 	if err != nil {
 		log.Error("create new MPRIS bridge failed", "err", err)
 		return
 	}
 	defer bdg.close()
 
-	if err := bdg.connect(errc); err != nil {
-		log.Error("connect to D-bus failed", "err", err)
-		return
+	bdg.connect(errc)
+
+	var (
+		feed         *entityFeed
+		ch           <-chan hassmessage.Message
+		stateChanged <-chan hassmessage.MediaPlayerData
+		registry     <-chan hassmessage.EntityRegistryUpdatedData
+	)
+
+	if cfg.Connection.Feed == feedStateChanged {
+		var sub *eventSubscription[hassmessage.MediaPlayerData]
+
+		sub, err = subscribeEvent[hassmessage.MediaPlayerData](
+			client, hassmessage.EventStateChanged, cfg.allowedMediaPlayer,
+		)
+		if err == nil {
+			stateChanged = sub.events()
+		}
+	} else {
+		var sub *eventSubscription[hassmessage.EntityRegistryUpdatedData]
+
+		feed = newEntityFeed(ctx, client)
+		ch = feed.messages()
+
+		sub, err = subscribeEvent[hassmessage.EntityRegistryUpdatedData](
+			client, hassmessage.EventEntityRegistryUpdated, cfg.allowedMediaPlayer,
+		)
+		if err == nil {
+			registry = sub.events()
+		}
 	}
 
-	if !getInitState(bdg) {
+	if err != nil {
+		log.Error("subscribe to HASS state changes failed", "feed", cfg.Connection.Feed, "err", err)
 		return
 	}
 
-	ch, err := client.subscribe(hassmessage.EventStateChanged)
-	if err != nil {
-		log.Error("subscribe to HASS state_changed event failed", "err", err)
+	entityIDs, ok := getInitState(bdg)
+	if !ok {
 		return
 	}
 
+	if feed != nil {
+		if err := feed.watch(entityIDs); err != nil {
+			log.Error("subscribe to HASS entities failed", "err", err)
+			return
+		}
+	}
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 
@@ -65,17 +110,38 @@ func main() {
 		case err := <-errc:
 			log.Error("unexpected error occur", "err", err)
 			return
-		case msg := <-ch:
-			if msg.Event.EventType == hassmessage.EventStateChanged {
-				var data hassmessage.MediaPlayerData
-
-				if err := json.Unmarshal(msg.Event.Data, &data); err != nil {
-					log.Error("unmarshal event data into state failed", "err", err)
-					continue
+		case state := <-client.connStates():
+			switch state {
+			case connStateDisconnected:
+				bdg.disconnected()
+			case connStateReconnected:
+				entityIDs, ok := getInitState(bdg)
+				if ok && feed != nil {
+					if err := feed.watch(entityIDs); err != nil {
+						log.Error("subscribe to HASS entities failed", "err", err)
+					}
 				}
+			}
+		case data := <-registry:
+			if err := feed.registryUpdated(data); err != nil {
+				log.Error("handle entity registry update failed", "err", err)
+			}
+		case msg := <-ch:
+			changed, removed := feed.apply(msg)
+			for _, state := range changed {
+				bdg.update(state)
+			}
 
-				bdg.update(data.State)
+			for _, entityID := range removed {
+				bdg.remove(entityID)
 			}
+		case data := <-stateChanged:
+			if data.State.EntityID == "" {
+				bdg.remove(data.EntityID)
+				continue
+			}
+
+			bdg.update(data.State)
 		}
 	}
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/linnovs/hass-mpris-bridge/internal/hassmessage"
+)
+
+// setString sets the metadata key only when value is not empty.
+func (m playerMetadata) setString(key, value string) {
+	if value != "" {
+		m[key] = dbus.MakeVariant(value)
+	}
+}
+
+// setList sets the metadata key with the non empty values.
+func (m playerMetadata) setList(key string, values ...string) {
+	list := make([]string, 0, len(values))
+
+	for _, v := range values {
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+
+	if len(list) > 0 {
+		m[key] = dbus.MakeVariant(list)
+	}
+}
+
+// setNumber sets the metadata key when value is a number, e.g., season and episode.
+func (m playerMetadata) setNumber(key, value string) {
+	if n, err := strconv.ParseInt(value, 10, 32); err == nil {
+		m[key] = dbus.MakeVariant(int32(n))
+	}
+}
+
+// dbusTrackPathFormat is the `mpris:trackid` object path of a track, the MPRIS spec reserves
+// the `/org/mpris` namespace so the tracks live under the bridge's own namespace.
+const dbusTrackPathFormat = "/" + desktopEntry + "/%s/track/%x"
+
+// trackID returns a stable `mpris:trackid` for the entity's current track.
+func trackID(state hassmessage.State) dbus.ObjectPath {
+	return trackPath(state.EntityID, state.ContentID(), state.Title(), state.Artist(), state.Album())
+}
+
+// trackPath returns a stable `mpris:trackid` of the entity's track derived from contentID, or the
+// track's title, artist and album if the content ID is unavailable.
+func trackPath(entityID, contentID, title, artist, album string) dbus.ObjectPath {
+	key := contentID
+	if key == "" {
+		key = strings.Join([]string{title, artist, album}, "\x00")
+	}
+
+	if strings.Trim(key, "\x00") == "" {
+		return dbusNoTrack
+	}
+
+	sum := sha256.Sum256([]byte(key))
+
+	return dbus.ObjectPath(fmt.Sprintf(dbusTrackPathFormat, objectID(entityID), sum[:8]))
+}
+
+// contentURL returns `media_content_id` if it is an URI, e.g., a stream URL or `spotify:` URI.
+func contentURL(state hassmessage.State) string {
+	u, err := url.Parse(state.ContentID())
+	if err != nil || u.Scheme == "" {
+		return ""
+	}
+
+	return u.String()
+}
+
+// queueItemMetadata maps the queue item to MPRIS metadata of the track list.
+func queueItemMetadata(id dbus.ObjectPath, item hassmessage.QueueItem) playerMetadata {
+	m := playerMetadata{
+		"mpris:trackid": dbus.MakeVariant(id),
+		"mpris:length":  dbus.MakeVariant(int64(item.Duration * microsecond)),
+	}
+
+	m.setString("mpris:artUrl", item.ImageURL)
+	m.setString("xesam:title", item.Title)
+	m.setList("xesam:artist", item.Artist)
+	m.setString("xesam:album", item.Album)
+
+	if u, err := url.Parse(item.ContentID); err == nil && u.Scheme != "" {
+		m.setString("xesam:url", item.ContentID)
+	}
+
+	return m
+}
+
+// splitTitle splits a radio style "Artist - Title" at the first separator found in title.
+func splitTitle(title string, separators []string) (artist, track string, ok bool) {
+	at, sepLen := -1, 0
+
+	for _, sep := range separators {
+		if n := strings.Index(title, sep); n > 0 && (at < 0 || n < at) {
+			at, sepLen = n, len(sep)
+		}
+	}
+
+	if at < 0 {
+		return "", "", false
+	}
+
+	artist = strings.TrimSpace(title[:at])
+	track = strings.TrimSpace(title[at+sepLen:])
+
+	return artist, track, artist != "" && track != ""
+}
+
+// clearedMetadata is the metadata of a player without any track.
+func clearedMetadata() playerMetadata {
+	return playerMetadata{"mpris:trackid": dbus.MakeVariant(dbusNoTrack)}
+}
+
+// metadata maps the entity's media attributes to MPRIS metadata by its content type.
+// see: https://www.freedesktop.org/wiki/Specifications/mpris-spec/metadata/
+func (b *bridge) metadata(state hassmessage.State, artURL string) playerMetadata {
+	m := playerMetadata{
+		"mpris:trackid": dbus.MakeVariant(trackID(state)),
+		"mpris:length":  dbus.MakeVariant(state.Duration()),
+	}
+
+	m.setString("mpris:artUrl", artURL)
+	m.setString("xesam:url", contentURL(state))
+	m.setList("xesam:albumArtist", state.AlbumArtist())
+	// xesam has no playlist field, the album is left for the track's own album
+	m.setList("xesam:comment", state.Playlist())
+
+	title, artist := state.Title(), state.Artist()
+	if artist == "" {
+		if a, t, ok := splitTitle(title, b.cfg.titleSeparators(state.EntityID)); ok {
+			artist, title = a, t
+		}
+	}
+
+	switch state.ContentType() {
+	case hassmessage.MediaContentTypeTVShow, hassmessage.MediaContentTypeEpisode:
+		m.setString("xesam:title", state.Title())
+		m.setList("xesam:artist", state.SeriesTitle())
+		m.setString("xesam:album", episodeLabel(state.Season(), state.Episode()))
+		m.setNumber("xesam:discNumber", state.Season())
+		m.setNumber("xesam:trackNumber", state.Episode())
+	case hassmessage.MediaContentTypeChannel:
+		if title == "" {
+			title = state.Channel()
+		}
+
+		if artist == "" {
+			artist = state.Channel()
+		}
+
+		m.setString("xesam:title", title)
+		m.setList("xesam:artist", artist)
+		m.setString("xesam:album", state.Channel())
+	case hassmessage.MediaContentTypePodcast:
+		album := state.Album()
+		if album == "" {
+			album = state.SeriesTitle()
+		}
+
+		m.setString("xesam:title", state.Title())
+		m.setList("xesam:artist", state.Artist())
+		m.setString("xesam:album", album)
+		m.setNumber("xesam:trackNumber", state.Episode())
+	case hassmessage.MediaContentTypeMovie, hassmessage.MediaContentTypeVideo:
+		m.setString("xesam:title", state.Title())
+		m.setList("xesam:artist", state.Artist(), state.AppName())
+		m.setString("xesam:album", state.Album())
+	default:
+		m.setString("xesam:title", title)
+		m.setList("xesam:artist", artist)
+		m.setString("xesam:album", state.Album())
+		m.setNumber("xesam:trackNumber", state.Track())
+	}
+
+	return m
+}
+
+// episodeLabel formats the season and episode, e.g., "S01E02", "Season 1" or "Episode 2".
+func episodeLabel(season, episode string) string {
+	sn, serr := strconv.Atoi(season)
+	ep, eerr := strconv.Atoi(episode)
+
+	switch {
+	case serr == nil && eerr == nil:
+		return fmt.Sprintf("S%02dE%02d", sn, ep)
+	case season != "" && episode != "":
+		return fmt.Sprintf("Season %s, Episode %s", season, episode)
+	case season != "":
+		return "Season " + season
+	case episode != "":
+		return "Episode " + episode
+	default:
+		return ""
+	}
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/godbus/dbus/v5"
@@ -13,6 +21,9 @@ import (
 const (
 	playerMinimumRate = float64(1)
 	playerMaximumRate = float64(1)
+	microsecond       = 1000 * 1000
+	dbusSeekedSignal  = dbusPlayerIface + ".Seeked"
+	dbusNoTrack       = dbus.ObjectPath("/org/mpris/MediaPlayer2/TrackList/NoTrack")
 )
 
 type playbackStatus string
@@ -33,24 +44,106 @@ const (
 
 type playerMetadata map[string]dbus.Variant
 
+var (
+	errUnsupportedURIScheme = errors.New("unsupported URI scheme")
+	errPlayMediaUnsupported = errors.New("player does not support playing media")
+)
+
+// dbusTimeoutError is the D-bus error name of a command HASS has not answered in time.
+const dbusTimeoutError = dbusObjectIface + ".Error.Timeout"
+
+// commandError maps the error of sending a command to a D-bus error, so clients can tell a
+// timed out command apart from a failed one.
+func commandError(err error) *dbus.Error {
+	if errors.Is(err, errCommandTimeout) {
+		return dbus.NewError(dbusTimeoutError, []any{err.Error()})
+	}
+
+	return dbus.MakeFailedError(err)
+}
+
+var (
+	audioMimeTypes = []string{
+		"audio/aac", "audio/flac", "audio/mpeg", "audio/ogg", "audio/wav", "audio/x-mpegurl",
+	}
+	videoMimeTypes = []string{
+		"application/x-mpegurl", "video/mp4", "video/webm", "video/x-matroska",
+	}
+)
+
+// contentMimeTypes are the MIME types advertised for the content types of the OpenUri schemes.
+var contentMimeTypes = map[string][]string{
+	hassmessage.MediaContentTypeMusic:   audioMimeTypes,
+	hassmessage.MediaContentTypePodcast: audioMimeTypes,
+	hassmessage.MediaContentTypeChannel: audioMimeTypes,
+	hassmessage.MediaContentTypeVideo:   videoMimeTypes,
+	hassmessage.MediaContentTypeMovie:   videoMimeTypes,
+	hassmessage.MediaContentTypeTVShow:  videoMimeTypes,
+	hassmessage.MediaContentTypeEpisode: videoMimeTypes,
+}
+
+// playerMethods maps the Go method name to D-bus method name which can't be used directly.
+var playerMethods = map[string]string{
+	"SeekOffset": "Seek",
+}
+
+// playerWriters are the writable Player properties forwarded to HASS, the writer returns the
+// value to be stored once HASS accepted it. They are called by [properties.Set] outside the lock
+// of [prop.Properties] as they wait for HASS.
+var playerWriters = map[string]func(p *player, value dbus.Variant) (dbus.Variant, *dbus.Error){
+	"Volume":     (*player).setVolume,
+	"Shuffle":    (*player).setShuffle,
+	"LoopStatus": (*player).setLoopStatus,
+}
+
 type player struct {
-	mux       sync.Mutex
-	client    *hassClient
-	entityID  string
-	propsSpec map[string]*prop.Prop
+	ctx        context.Context
+	mux        sync.Mutex
+	client     *hassClient
+	conn       *dbus.Conn
+	entityID   string
+	propsSpec  map[string]*prop.Prop
+	properties *prop.Properties
+	features   atomic.Int64
+	tracker    positionTracker
+	uriSchemes map[string]string // URI scheme to `media_content_type` for OpenUri
+	closeMux   sync.RWMutex
+	closed     bool // set once the instance is closed, nothing is published after
+}
+
+// setProperty sets the property unless the instance has been closed, as SetMust panics once the
+// D-bus connection is closed. It must be used by the goroutines which may outlive the instance.
+func (p *player) setProperty(iface, property string, v any) {
+	p.closeMux.RLock()
+	defer p.closeMux.RUnlock()
+
+	if p.closed {
+		return
+	}
+
+	p.properties.SetMust(iface, property, v)
 }
 
 func (p *player) callService(
 	service hassmessage.ServiceType,
 	data *hassmessage.CommandData,
 ) *dbus.Error {
+	_, err := p.callDomainService(hassmessage.DomainMediaPlayer, service, data, false)
+	return err
+}
+
+// callDomainService calls the service of domain on the entity, the service response is only
+// returned when returnResponse is set.
+func (p *player) callDomainService(
+	domain hassmessage.ServiceDomain,
+	service hassmessage.ServiceType,
+	data *hassmessage.CommandData,
+	returnResponse bool,
+) (result hassmessage.ServiceResult, derr *dbus.Error) {
 	p.mux.Lock()
 	defer p.mux.Unlock()
 
-	domain := hassmessage.DomainMediaPlayer
-	rtResp := false
-
-	id, msg, err := p.client.sendCommand(hassmessage.Command{
+	msg, err := p.client.sendCommand(p.ctx, hassmessage.Command{
 		Type:    hassmessage.TypeCallService,
 		Domain:  domain,
 		Service: service,
@@ -58,55 +151,312 @@ func (p *player) callService(
 			EntityID: p.entityID,
 		},
 		ServiceData:    data,
-		ReturnResponse: &rtResp,
+		ReturnResponse: &returnResponse,
 	})
 	if err != nil {
 		if err == errCommandFailed {
 			log.Error("HASS call_service command failed", "err", msg.Error.Message)
-			return dbus.MakeFailedError(errors.New(msg.Error.Message))
+			return result, dbus.MakeFailedError(errors.New(msg.Error.Message))
 		}
-		return dbus.MakeFailedError(err)
+		return result, commandError(err)
 	}
 
-	p.client.commandDone(id)
+	if returnResponse {
+		if err := msg.DecodeResult(&result); err != nil {
+			return result, dbus.MakeFailedError(err)
+		}
+	}
 
-	return nil
+	return result, nil
 }
 
 // Next skips to the next track in the tracklist.
 // see: https://specifications.freedesktop.org/mpris-spec/latest/Player_Interface.html#Method:Next
 func (p *player) Next() *dbus.Error {
+	if !p.supports(hassmessage.MediaPlayerFeatureNextTrack) {
+		return nil
+	}
+
 	return p.callService(hassmessage.ServiceNext, nil)
 }
 
 // Previous skips to the previous track in the tracklist.
 // see: https://specifications.freedesktop.org/mpris-spec/latest/Player_Interface.html#Method:Previous
 func (p *player) Previous() *dbus.Error {
+	if !p.supports(hassmessage.MediaPlayerFeaturePreviousTrack) {
+		return nil
+	}
+
 	return p.callService(hassmessage.ServicePrevious, nil)
 }
 
 // Pause pauses playback.
 // see: https://specifications.freedesktop.org/mpris-spec/latest/Player_Interface.html#Method:Pause
 func (p *player) Pause() *dbus.Error {
+	if !p.supports(hassmessage.MediaPlayerFeaturePause) {
+		return nil
+	}
+
 	return p.callService(hassmessage.ServicePause, nil)
 }
 
 // PlayPause pauses playback.
 // see: https://specifications.freedesktop.org/mpris-spec/latest/Player_Interface.html#Method:PlayPause
 func (p *player) PlayPause() *dbus.Error {
+	if !p.supports(hassmessage.MediaPlayerFeaturePause) {
+		return nil
+	}
+
 	return p.callService(hassmessage.ServicePlayPause, nil)
 }
 
 // Play start or resumes playback.
 // see: https://specifications.freedesktop.org/mpris-spec/latest/Player_Interface.html#Method:Play
 func (p *player) Play() *dbus.Error {
+	if !p.supports(hassmessage.MediaPlayerFeaturePlay) {
+		return nil
+	}
+
 	return p.callService(hassmessage.ServicePlay, nil)
 }
 
-func (p *player) setEntityID(id string) {
-	p.mux.Lock()
-	defer p.mux.Unlock()
-	p.entityID = id
+// Stop stops playback.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Player_Interface.html#Method:Stop
+func (p *player) Stop() *dbus.Error {
+	if !p.supports(hassmessage.MediaPlayerFeatureStop) {
+		return nil
+	}
+
+	return p.callService(hassmessage.ServiceStop, nil)
+}
+
+// OpenUri opens the URI with `play_media`, the URI scheme must be one of the configured schemes.
+// The schemes are advertised regardless of the entity's features, so an error is returned if it
+// can't play media.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Player_Interface.html#Method:OpenUri
+func (p *player) OpenUri(uri string) *dbus.Error { //nolint:revive // D-bus method name
+	if !p.supports(hassmessage.MediaPlayerFeaturePlayMedia) {
+		return dbus.MakeFailedError(errPlayMediaUnsupported)
+	}
+
+	return p.playMedia(uri, "")
+}
+
+// playMedia calls `play_media` with the URI and the content type of its scheme, enqueue is one
+// of the `hassmessage.Enqueue*` modes or empty to replace the current media.
+func (p *player) playMedia(uri, enqueue string) *dbus.Error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+
+	contentType, ok := p.uriSchemes[strings.ToLower(u.Scheme)]
+	if !ok {
+		return dbus.MakeFailedError(fmt.Errorf("%w: %q", errUnsupportedURIScheme, u.Scheme))
+	}
+
+	return p.callService(hassmessage.ServicePlayMedia, &hassmessage.CommandData{
+		ContentID:   uri,
+		ContentType: contentType,
+		Enqueue:     enqueue,
+	})
+}
+
+// SeekOffset seeks forward or backward in the current track by the specified number of
+// microseconds, exported as `Seek` by [playerMethods] as the name is reserved for [io.Seeker].
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Player_Interface.html#Method:Seek
+func (p *player) SeekOffset(offset int64) *dbus.Error {
+	if !p.supports(hassmessage.MediaPlayerFeatureSeek) {
+		return nil
+	}
+
+	position := p.position() + offset
+	if position < 0 {
+		position = 0
+	}
+
+	if length := p.length(); length > 0 && position > length {
+		return p.Next()
+	}
+
+	return p.seek(position)
+}
+
+// SetPosition sets the current track position in microseconds.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Player_Interface.html#Method:SetPosition
+func (p *player) SetPosition(trackID dbus.ObjectPath, position int64) *dbus.Error {
+	if !p.supports(hassmessage.MediaPlayerFeatureSeek) {
+		return nil
+	}
+
+	if current := p.trackID(); trackID != current {
+		log.Debug("ignore stale SetPosition call", "track", trackID, "current", current)
+		return nil
+	}
+
+	if length := p.length(); position < 0 || (length > 0 && position > length) {
+		log.Debug("ignore SetPosition call out of range", "position", position, "length", length)
+		return nil
+	}
+
+	return p.seek(position)
+}
+
+// seek calls `media_seek` with the position in microseconds then emit the `Seeked` signal.
+func (p *player) seek(position int64) *dbus.Error {
+	seconds := float64(position) / microsecond
+
+	if err := p.callService(
+		hassmessage.ServiceSeek,
+		&hassmessage.CommandData{SeekPosition: &seconds},
+	); err != nil {
+		return err
+	}
+
+	p.tracker.set(position)
+	p.seeked(position)
+
+	return nil
+}
+
+// seeked emits the `Seeked` signal.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Player_Interface.html#Signal:Seeked
+func (p *player) seeked(position int64) {
+	if err := p.conn.Emit(dbusObjectPath, dbusSeekedSignal, position); err != nil {
+		log.Error("emit Seeked signal failed", "err", err)
+	}
+}
+
+func (p *player) position() int64 {
+	return p.tracker.current(time.Now())
+}
+
+func (p *player) metadata() playerMetadata {
+	metadata, _ := p.properties.GetMust(dbusPlayerIface, "Metadata").(playerMetadata)
+	return metadata
+}
+
+func (p *player) length() int64 {
+	length, _ := p.metadata()["mpris:length"].Value().(int64)
+	return length
+}
+
+func (p *player) trackID() dbus.ObjectPath {
+	if trackID, ok := p.metadata()["mpris:trackid"].Value().(dbus.ObjectPath); ok {
+		return trackID
+	}
+
+	return dbusNoTrack
+}
+
+// setFeatures stores the entity's `supported_features` and reports whether they have changed.
+func (p *player) setFeatures(features hassmessage.MediaPlayerFeature) (changed bool) {
+	return p.features.Swap(int64(features)) != int64(features)
+}
+
+func (p *player) supports(feature hassmessage.MediaPlayerFeature) bool {
+	return hassmessage.MediaPlayerFeature(p.features.Load()).Has(feature)
+}
+
+// capabilities returns the `Can*` properties derived from the entity's `supported_features`.
+func (p *player) capabilities() map[string]dbus.Variant {
+	return map[string]dbus.Variant{
+		"CanGoNext":     dbus.MakeVariant(p.supports(hassmessage.MediaPlayerFeatureNextTrack)),
+		"CanGoPrevious": dbus.MakeVariant(p.supports(hassmessage.MediaPlayerFeaturePreviousTrack)),
+		"CanPlay":       dbus.MakeVariant(p.supports(hassmessage.MediaPlayerFeaturePlay)),
+		"CanPause":      dbus.MakeVariant(p.supports(hassmessage.MediaPlayerFeaturePause)),
+		"CanSeek":       dbus.MakeVariant(p.supports(hassmessage.MediaPlayerFeatureSeek)),
+	}
+}
+
+// supportedURISchemes returns the URI schemes accepted by OpenUri.
+func (p *player) supportedURISchemes() []string {
+	return slices.Sorted(maps.Keys(p.uriSchemes))
+}
+
+// supportedMimeTypes returns the MIME types of the content types accepted by OpenUri.
+func (p *player) supportedMimeTypes() []string {
+	mimeTypes := []string{}
+
+	for _, contentType := range p.uriSchemes {
+		mimeTypes = append(mimeTypes, contentMimeTypes[contentType]...)
+	}
+
+	slices.Sort(mimeTypes)
+
+	return slices.Compact(mimeTypes)
+}
+
+// setVolume calls `volume_set` when a client writes the Volume property, the value is clamped
+// between 0 and 1 as HASS does not support amplification.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Player_Interface.html#Property:Volume
+func (p *player) setVolume(value dbus.Variant) (dbus.Variant, *dbus.Error) {
+	if !p.supports(hassmessage.MediaPlayerFeatureVolumeSet) {
+		return value, prop.ErrReadOnly
+	}
+
+	volume, ok := value.Value().(float64)
+	if !ok {
+		return value, prop.ErrInvalidArg
+	}
+
+	volume = max(0, min(1, volume))
+
+	if err := p.callService(
+		hassmessage.ServiceVolumeSet,
+		&hassmessage.CommandData{VolumeLevel: &volume},
+	); err != nil {
+		return value, err
+	}
+
+	return dbus.MakeVariant(volume), nil
+}
+
+// setShuffle calls `shuffle_set` when a client writes the Shuffle property.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Player_Interface.html#Property:Shuffle
+func (p *player) setShuffle(value dbus.Variant) (dbus.Variant, *dbus.Error) {
+	if !p.supports(hassmessage.MediaPlayerFeatureShuffleSet) {
+		return value, prop.ErrReadOnly
+	}
+
+	shuffle, ok := value.Value().(bool)
+	if !ok {
+		return value, prop.ErrInvalidArg
+	}
+
+	err := p.callService(hassmessage.ServiceShuffle, &hassmessage.CommandData{Shuffle: &shuffle})
+
+	return value, err
+}
+
+// setLoopStatus calls `repeat_set` when a client writes the LoopStatus property.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Player_Interface.html#Property:LoopStatus
+func (p *player) setLoopStatus(value dbus.Variant) (dbus.Variant, *dbus.Error) {
+	if !p.supports(hassmessage.MediaPlayerFeatureRepeatSet) {
+		return value, prop.ErrReadOnly
+	}
+
+	status, ok := value.Value().(string)
+	if !ok {
+		return value, prop.ErrInvalidArg
+	}
+
+	var mode string
+
+	switch loopStatus(status) {
+	case loopNone:
+		mode = hassmessage.RepeatModeOff
+	case loopTrack:
+		mode = hassmessage.RepeatModeOne
+	case loopPlaylist:
+		mode = hassmessage.RepeatModeAll
+	default:
+		return value, prop.ErrInvalidArg
+	}
+
+	err := p.callService(hassmessage.ServiceRepeat, &hassmessage.CommandData{RepeatMode: mode})
+
+	return value, err
 }
 
 func (p *player) props() map[string]*prop.Prop {
@@ -119,16 +469,16 @@ func (p *player) props() map[string]*prop.Prop {
 		"LoopStatus":     {Value: loopNone, Writable: true, Emit: prop.EmitTrue},
 		"Rate":           {Value: float64(1), Writable: true, Emit: prop.EmitTrue},
 		"Shuffle":        {Value: false, Writable: true, Emit: prop.EmitTrue},
-		"Metadata":       {Value: playerMetadata{}, Writable: false, Emit: prop.EmitTrue},
+		"Metadata":       {Value: clearedMetadata(), Writable: false, Emit: prop.EmitTrue},
 		"Volume":         {Value: float64(0), Writable: true, Emit: prop.EmitTrue},
-		"Position":       {Value: int64(0), Writable: false, Emit: prop.EmitTrue},
+		"Position":       {Value: int64(0), Writable: false, Emit: prop.EmitFalse},
 		"MinimumRate":    {Value: playerMinimumRate, Writable: false, Emit: prop.EmitTrue},
 		"MaximumRate":    {Value: playerMaximumRate, Writable: false, Emit: prop.EmitTrue},
-		"CanGoNext":      {Value: true, Writable: false, Emit: prop.EmitTrue},
-		"CanGoPrevious":  {Value: true, Writable: false, Emit: prop.EmitTrue},
-		"CanPlay":        {Value: true, Writable: false, Emit: prop.EmitTrue},
-		"CanPause":       {Value: true, Writable: false, Emit: prop.EmitTrue},
-		"CanSeek":        {Value: true, Writable: false, Emit: prop.EmitTrue},
+		"CanGoNext":      {Value: false, Writable: false, Emit: prop.EmitTrue},
+		"CanGoPrevious":  {Value: false, Writable: false, Emit: prop.EmitTrue},
+		"CanPlay":        {Value: false, Writable: false, Emit: prop.EmitTrue},
+		"CanPause":       {Value: false, Writable: false, Emit: prop.EmitTrue},
+		"CanSeek":        {Value: false, Writable: false, Emit: prop.EmitTrue},
 		"CanControl":     {Value: true, Writable: false, Emit: prop.EmitFalse},
 	}
 
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+	"github.com/linnovs/hass-mpris-bridge/internal/hassmessage"
+)
+
+const testEntityID = "media_player.kitchen"
+
+// newTestPlayer returns a player of [testEntityID] supporting the features, connected to the
+// fake server but not exported on D-bus.
+func newTestPlayer(t *testing.T, f *fakeHASS, features hassmessage.MediaPlayerFeature) *player {
+	t.Helper()
+
+	client, _ := newTestClient(t, f)
+	p := &player{
+		ctx:        context.Background(),
+		client:     client,
+		entityID:   testEntityID,
+		uriSchemes: map[string]string{"spotify": hassmessage.MediaContentTypeMusic},
+	}
+	p.setFeatures(features)
+
+	return p
+}
+
+// lastServiceCall returns the latest `call_service` command received by the fake server.
+func lastServiceCall(t *testing.T, f *fakeHASS) hassmessage.Command {
+	t.Helper()
+
+	cmds := f.commands(0, hassmessage.TypeCallService)
+	if len(cmds) == 0 {
+		t.Fatal("no call_service command received")
+	}
+
+	return cmds[len(cmds)-1]
+}
+
+func TestPlayerControls(t *testing.T) {
+	tests := []struct {
+		name    string
+		call    func(p *player) *dbus.Error
+		feature hassmessage.MediaPlayerFeature
+		service hassmessage.ServiceType
+	}{
+		{"Play", (*player).Play, hassmessage.MediaPlayerFeaturePlay, hassmessage.ServicePlay},
+		{"Pause", (*player).Pause, hassmessage.MediaPlayerFeaturePause, hassmessage.ServicePause},
+		{
+			"PlayPause", (*player).PlayPause,
+			hassmessage.MediaPlayerFeaturePause, hassmessage.ServicePlayPause,
+		},
+		{"Stop", (*player).Stop, hassmessage.MediaPlayerFeatureStop, hassmessage.ServiceStop},
+		{"Next", (*player).Next, hassmessage.MediaPlayerFeatureNextTrack, hassmessage.ServiceNext},
+		{
+			"Previous", (*player).Previous,
+			hassmessage.MediaPlayerFeaturePreviousTrack, hassmessage.ServicePrevious,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeHASS(t)
+			p := newTestPlayer(t, f, tt.feature)
+
+			if err := tt.call(p); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+
+			cmd := lastServiceCall(t, f)
+			if cmd.Domain != hassmessage.DomainMediaPlayer || cmd.Service != tt.service {
+				t.Errorf("service: got %s.%s, want %s.%s",
+					cmd.Domain, cmd.Service, hassmessage.DomainMediaPlayer, tt.service)
+			}
+
+			if cmd.Target == nil || cmd.Target.EntityID != testEntityID {
+				t.Errorf("target: got %+v, want %s", cmd.Target, testEntityID)
+			}
+		})
+	}
+}
+
+func TestPlayerUnsupportedFeature(t *testing.T) {
+	f := newFakeHASS(t)
+	p := newTestPlayer(t, f, hassmessage.MediaPlayerFeaturePause)
+
+	if err := p.Play(); err != nil {
+		t.Fatalf("Play: %v", err)
+	}
+
+	if cmds := f.commands(0, hassmessage.TypeCallService); len(cmds) != 0 {
+		t.Fatalf("call_service for unsupported feature: got %+v, want none", cmds)
+	}
+}
+
+func TestPlayerSetVolume(t *testing.T) {
+	f := newFakeHASS(t)
+	p := newTestPlayer(t, f, hassmessage.MediaPlayerFeatureVolumeSet)
+
+	for _, tt := range []struct{ volume, want float64 }{{0.4, 0.4}, {1.5, 1}, {-1, 0}} {
+		value, err := p.setVolume(dbus.MakeVariant(tt.volume))
+		if err != nil {
+			t.Fatalf("set Volume %v: %v", tt.volume, err)
+		}
+
+		if value.Value() != tt.want {
+			t.Errorf("set Volume %v: stored %v, want %v", tt.volume, value.Value(), tt.want)
+		}
+
+		cmd := lastServiceCall(t, f)
+		if cmd.Service != hassmessage.ServiceVolumeSet || cmd.ServiceData == nil ||
+			cmd.ServiceData.VolumeLevel == nil || *cmd.ServiceData.VolumeLevel != tt.want {
+			t.Errorf("set Volume %v: got %+v, want volume_level %v", tt.volume, cmd, tt.want)
+		}
+	}
+
+	if _, err := p.setVolume(dbus.MakeVariant("loud")); err != prop.ErrInvalidArg {
+		t.Errorf("set Volume with invalid value: got %v, want %v", err, prop.ErrInvalidArg)
+	}
+}
+
+func TestPlayerSetVolumeFailed(t *testing.T) {
+	f := newFakeHASS(t)
+	f.fail(hassmessage.TypeCallService, "home_assistant_error", "Player is offline")
+	p := newTestPlayer(t, f, hassmessage.MediaPlayerFeatureVolumeSet)
+	props := &properties{player: p}
+
+	err := props.Set(dbusPlayerIface, "Volume", dbus.MakeVariant(0.4))
+	if err == nil {
+		t.Fatal("set Volume: got no error")
+	}
+
+	if err.Error() != "Player is offline" {
+		t.Errorf("error message: got %q, want the HASS error message", err.Error())
+	}
+
+	if cmd := lastServiceCall(t, f); cmd.Service != hassmessage.ServiceVolumeSet {
+		t.Errorf("service: got %s, want %s", cmd.Service, hassmessage.ServiceVolumeSet)
+	}
+}
+
+func TestPlayerSetLoopStatus(t *testing.T) {
+	f := newFakeHASS(t)
+	p := newTestPlayer(t, f, hassmessage.MediaPlayerFeatureRepeatSet)
+
+	for status, mode := range map[loopStatus]string{
+		loopNone:     hassmessage.RepeatModeOff,
+		loopTrack:    hassmessage.RepeatModeOne,
+		loopPlaylist: hassmessage.RepeatModeAll,
+	} {
+		if _, err := p.setLoopStatus(dbus.MakeVariant(string(status))); err != nil {
+			t.Fatalf("set LoopStatus %s: %v", status, err)
+		}
+
+		cmd := lastServiceCall(t, f)
+		if cmd.Service != hassmessage.ServiceRepeat || cmd.ServiceData.RepeatMode != mode {
+			t.Errorf("set LoopStatus %s: got %+v, want repeat %s", status, cmd, mode)
+		}
+	}
+}
+
+func TestPlayerOpenUri(t *testing.T) {
+	f := newFakeHASS(t)
+	p := newTestPlayer(t, f, hassmessage.MediaPlayerFeaturePlayMedia)
+
+	if err := p.OpenUri("spotify:track:1"); err != nil {
+		t.Fatalf("OpenUri: %v", err)
+	}
+
+	cmd := lastServiceCall(t, f)
+	if cmd.Service != hassmessage.ServicePlayMedia ||
+		cmd.ServiceData.ContentID != "spotify:track:1" ||
+		cmd.ServiceData.ContentType != hassmessage.MediaContentTypeMusic {
+		t.Errorf("OpenUri: got %+v, want play_media of the spotify track", cmd.ServiceData)
+	}
+
+	if err := p.OpenUri("ftp://example.com/song.mp3"); err == nil {
+		t.Error("OpenUri with unsupported scheme: got no error")
+	}
+
+	p.setFeatures(0)
+
+	if err := p.OpenUri("spotify:track:2"); err == nil {
+		t.Error("OpenUri without play_media support: got no error")
+	}
+}
+
+func TestPlayerServiceFailed(t *testing.T) {
+	f := newFakeHASS(t)
+	f.fail(hassmessage.TypeCallService, "home_assistant_error", "Player is offline")
+	p := newTestPlayer(t, f, hassmessage.MediaPlayerFeaturePlay)
+
+	err := p.Play()
+	if err == nil {
+		t.Fatal("Play: got no error")
+	}
+
+	if want := "org.freedesktop.DBus.Error.Failed"; err.Name != want {
+		t.Errorf("error name: got %s, want %s", err.Name, want)
+	}
+
+	if err.Error() != "Player is offline" {
+		t.Errorf("error message: got %q, want the HASS error message", err.Error())
+	}
+}
+
+func TestPlayerServiceTimeout(t *testing.T) {
+	f := newFakeHASS(t)
+	f.ignore(hassmessage.TypeCallService)
+	p := newTestPlayer(t, f, hassmessage.MediaPlayerFeaturePlay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	p.ctx = ctx
+
+	err := p.Play()
+	if err == nil || err.Name != dbusTimeoutError {
+		t.Fatalf("Play without answer: got %v, want %s", err, dbusTimeoutError)
+	}
+}
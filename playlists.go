@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+	"github.com/linnovs/hass-mpris-bridge/internal/hassmessage"
+)
+
+const (
+	dbusPlaylistsIface         = dbusObjectIface + ".Playlists"
+	dbusPlaylistChangedSignal  = dbusPlaylistsIface + ".PlaylistChanged"
+	dbusPlaylistPathFormat     = "/" + desktopEntry + "/%s/playlist/%x"
+	playlistOrderAlphabetical  = "Alphabetical"
+	playlistOrderUserDefined   = "UserDefined"
+	dbusNoPlaylist             = dbus.ObjectPath("/")
+	playlistBrowseExpandLevels = 1
+	playlistMaxAge             = time.Minute
+)
+
+var errNoPlaylist = errors.New("no such playlist")
+
+// playlist is the `(oss)` playlist struct of the MPRIS Playlists interface.
+type playlist struct {
+	ID   dbus.ObjectPath
+	Name string
+	Icon string
+}
+
+// activePlaylist is the `(b(oss))` maybe playlist struct of the ActivePlaylist property.
+type activePlaylist struct {
+	Valid    bool
+	Playlist playlist
+}
+
+// playlistItem is a playable item of the HASS media browser listed as a playlist.
+type playlistItem struct {
+	playlist
+	contentID   string
+	contentType string
+}
+
+// playlists implements `org.mpris.MediaPlayer2.Playlists` backed by the HASS media browser, the
+// playable items of the root and its directories, e.g., favorites, playlists and radio presets.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Playlists_Interface.html
+type playlists struct {
+	mux        sync.Mutex
+	refreshMux sync.Mutex
+	player     *player
+	propsSpec  map[string]*prop.Prop
+	items      []playlistItem  // in the order of the media browser
+	active     dbus.ObjectPath // empty if no playlist is active
+	fetchedAt  time.Time       // when items were fetched from the media browser
+	refreshing atomic.Bool
+}
+
+// ActivatePlaylist plays the playlist with `play_media`.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Playlists_Interface.html#Method:ActivatePlaylist
+func (l *playlists) ActivatePlaylist(playlistID dbus.ObjectPath) *dbus.Error {
+	if !l.player.supports(hassmessage.MediaPlayerFeaturePlayMedia) {
+		return nil
+	}
+
+	item, ok := l.lookup(playlistID)
+	if !ok {
+		return dbus.MakeFailedError(errNoPlaylist)
+	}
+
+	if err := l.player.callService(hassmessage.ServicePlayMedia, &hassmessage.CommandData{
+		ContentID:   item.contentID,
+		ContentType: item.contentType,
+	}); err != nil {
+		return err
+	}
+
+	l.setActive(item.ID)
+
+	return nil
+}
+
+// GetPlaylists returns the playlists from the media browser without waiting for HASS, the list
+// is fetched again in background once older than [playlistMaxAge] so the added or removed
+// favorites are reflected.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Playlists_Interface.html#Method:GetPlaylists
+func (l *playlists) GetPlaylists(
+	index, maxCount uint32,
+	order string,
+	reverseOrder bool,
+) ([]playlist, *dbus.Error) {
+	l.mux.Lock()
+	list := make([]playlist, 0, len(l.items))
+	for _, item := range l.items {
+		list = append(list, item.playlist)
+	}
+	stale := time.Since(l.fetchedAt) > playlistMaxAge
+	l.mux.Unlock()
+
+	if stale {
+		l.refreshAsync()
+	}
+
+	if order == playlistOrderAlphabetical {
+		slices.SortStableFunc(list, func(a, b playlist) int {
+			return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		})
+	}
+
+	if reverseOrder {
+		slices.Reverse(list)
+	}
+
+	if int64(index) >= int64(len(list)) {
+		return []playlist{}, nil
+	}
+
+	list = list[index:]
+	if int64(maxCount) < int64(len(list)) {
+		list = list[:maxCount]
+	}
+
+	return list, nil
+}
+
+// lookup returns the playlist item, the playlists are fetched again if it is not found.
+func (l *playlists) lookup(playlistID dbus.ObjectPath) (playlistItem, bool) {
+	find := func() (playlistItem, bool) {
+		l.mux.Lock()
+		defer l.mux.Unlock()
+
+		i := slices.IndexFunc(l.items, func(item playlistItem) bool { return item.ID == playlistID })
+		if i < 0 {
+			return playlistItem{}, false
+		}
+
+		return l.items[i], true
+	}
+
+	if item, ok := find(); ok {
+		return item, true
+	}
+
+	l.refresh()
+
+	return find()
+}
+
+// refreshAsync refreshes the playlists in background unless a refresh is already running.
+func (l *playlists) refreshAsync() {
+	if !l.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer l.refreshing.Store(false)
+		l.refresh()
+	}()
+}
+
+// supported reports whether the entity's media can be browsed and played.
+func (l *playlists) supported() bool {
+	return l.player.supports(hassmessage.MediaPlayerFeatureBrowseMedia) &&
+		l.player.supports(hassmessage.MediaPlayerFeaturePlayMedia)
+}
+
+// refresh fetches the playlists from the media browser and updates the PlaylistCount property,
+// the ActivePlaylist property is reset if the active playlist is no longer listed.
+func (l *playlists) refresh() {
+	l.refreshMux.Lock()
+	defer l.refreshMux.Unlock()
+
+	entityID := l.player.entityID
+	items := []playlistItem{}
+
+	if l.supported() {
+		var err error
+
+		items, err = l.browse(hassmessage.BrowseMedia{}, playlistBrowseExpandLevels, items)
+		if err != nil {
+			log.Error("browse player media failed", "entity", entityID, "err", err)
+			return
+		}
+	}
+
+	l.mux.Lock()
+	previous := l.items
+	l.items, l.fetchedAt = items, time.Now()
+	// the active playlist is gone, e.g., removed from the favorites
+	deactivated := l.active != "" &&
+		!slices.ContainsFunc(items, func(item playlistItem) bool { return item.ID == l.active })
+	if deactivated {
+		l.active = ""
+	}
+	l.mux.Unlock()
+
+	if deactivated {
+		l.player.setProperty(dbusPlaylistsIface, "ActivePlaylist", dbus.MakeVariant(noPlaylist()))
+	}
+
+	if len(previous) != len(items) {
+		log.Debug("player playlists changed", "entity", entityID, "playlists", len(items))
+		l.player.setProperty(
+			dbusPlaylistsIface, "PlaylistCount", dbus.MakeVariant(uint32(len(items))),
+		)
+	}
+
+	for _, item := range items {
+		i := slices.IndexFunc(previous, func(p playlistItem) bool { return p.ID == item.ID })
+		if i < 0 || previous[i].playlist == item.playlist {
+			continue
+		}
+
+		// the playlist was renamed or its icon has changed
+		err := l.player.conn.Emit(dbusObjectPath, dbusPlaylistChangedSignal, item.playlist)
+		if err != nil {
+			log.Error("emit PlaylistChanged signal failed", "err", err)
+		}
+	}
+}
+
+// browse appends the playable children of the media to items, the directories are expanded
+// until levels are exhausted.
+func (l *playlists) browse(
+	media hassmessage.BrowseMedia,
+	levels int,
+	items []playlistItem,
+) ([]playlistItem, error) {
+	entityID := l.player.entityID
+
+	result, err := l.player.client.browseMedia(
+		l.player.ctx, entityID, media.MediaContentID, media.MediaContentType,
+	)
+	if err != nil {
+		return items, err
+	}
+
+	for _, child := range result.Children {
+		switch {
+		case child.CanPlay:
+			id := playlistPath(entityID, child.MediaContentType, child.MediaContentID)
+			if slices.ContainsFunc(items, func(item playlistItem) bool { return item.ID == id }) {
+				continue
+			}
+
+			items = append(items, playlistItem{
+				playlist: playlist{
+					ID: id, Name: child.Title, Icon: thumbnailURL(child.Thumbnail),
+				},
+				contentID:   child.MediaContentID,
+				contentType: child.MediaContentType,
+			})
+		case child.CanExpand && child.MediaClass == hassmessage.MediaClassDirectory && levels > 0:
+			items, err = l.browse(child, levels-1, items)
+			if err != nil {
+				log.Debug(
+					"browse media directory failed", "entity", entityID, "title", child.Title, "err", err,
+				)
+			}
+		}
+	}
+
+	return items, nil
+}
+
+// activate sets the ActivePlaylist property to the playlist named by the entity's
+// `media_playlist` attribute, it is reset if the attribute names none of the playlists.
+func (l *playlists) activate(state hassmessage.State) {
+	name := state.Playlist()
+
+	l.mux.Lock()
+	i := slices.IndexFunc(l.items, func(item playlistItem) bool { return item.Name == name })
+	playlistID := dbusNoPlaylist
+	if name != "" && i >= 0 {
+		playlistID = l.items[i].ID
+	}
+	l.mux.Unlock()
+
+	l.setActive(playlistID)
+}
+
+// setActive sets the ActivePlaylist property if it has changed, [dbusNoPlaylist] resets it.
+func (l *playlists) setActive(playlistID dbus.ObjectPath) {
+	l.mux.Lock()
+	if l.active == playlistID || (l.active == "" && playlistID == dbusNoPlaylist) {
+		l.mux.Unlock()
+		return
+	}
+
+	if playlistID == dbusNoPlaylist {
+		l.active = ""
+		l.mux.Unlock()
+
+		l.player.setProperty(dbusPlaylistsIface, "ActivePlaylist", dbus.MakeVariant(noPlaylist()))
+
+		return
+	}
+
+	i := slices.IndexFunc(l.items, func(item playlistItem) bool { return item.ID == playlistID })
+	if i < 0 {
+		l.mux.Unlock()
+		return
+	}
+
+	l.active = playlistID
+	active := activePlaylist{Valid: true, Playlist: l.items[i].playlist}
+	l.mux.Unlock()
+
+	l.player.setProperty(dbusPlaylistsIface, "ActivePlaylist", dbus.MakeVariant(active))
+}
+
+// noPlaylist returns the ActivePlaylist value of no active playlist.
+func noPlaylist() activePlaylist {
+	return activePlaylist{Playlist: playlist{ID: dbusNoPlaylist}}
+}
+
+// playlistPath returns a stable playlist ID of the entity's media browser item.
+func playlistPath(entityID, contentType, contentID string) dbus.ObjectPath {
+	sum := sha256.Sum256([]byte(contentType + "\x00" + contentID))
+	return dbus.ObjectPath(fmt.Sprintf(dbusPlaylistPathFormat, objectID(entityID), sum[:8]))
+}
+
+// thumbnailURL returns the thumbnail if it is an absolute URL, the thumbnails proxied by HASS
+// require authentication which MPRIS clients can't provide.
+func thumbnailURL(thumbnail string) string {
+	u, err := url.Parse(thumbnail)
+	if err != nil || !u.IsAbs() {
+		return ""
+	}
+
+	return u.String()
+}
+
+func (l *playlists) props() map[string]*prop.Prop {
+	if l.propsSpec != nil {
+		return l.propsSpec
+	}
+
+	l.propsSpec = map[string]*prop.Prop{
+		"PlaylistCount": {Value: uint32(0), Writable: false, Emit: prop.EmitTrue},
+		"Orderings": {
+			Value:    []string{playlistOrderAlphabetical, playlistOrderUserDefined},
+			Writable: false,
+			Emit:     prop.EmitTrue,
+		},
+		"ActivePlaylist": {
+			Value:    noPlaylist(),
+			Writable: false,
+			Emit:     prop.EmitTrue,
+		},
+	}
+
+	return l.propsSpec
+}
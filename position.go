@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+// seekedThreshold is how far the reported position may differ from the extrapolated one before
+// it is treated as a seek, HASS rounds the position to seconds.
+const seekedThreshold = 2 * microsecond
+
+// positionTracker extrapolates the track position from the position HASS reported and the
+// time it was reported at, as HASS does not update the position while playing.
+type positionTracker struct {
+	mux       sync.Mutex
+	position  int64 // in microseconds at updatedAt
+	length    int64
+	updatedAt time.Time
+	playing   bool
+}
+
+// current returns the extrapolated position at now in microseconds.
+func (t *positionTracker) current(now time.Time) int64 {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	return t.extrapolate(now)
+}
+
+func (t *positionTracker) extrapolate(now time.Time) int64 {
+	position := t.position
+	if t.playing && !t.updatedAt.IsZero() && now.After(t.updatedAt) {
+		position += now.Sub(t.updatedAt).Microseconds()
+	}
+
+	if t.length > 0 {
+		position = min(position, t.length)
+	}
+
+	return position
+}
+
+// update sets the reported position and reports whether it jumps away from the extrapolated
+// position, i.e., the track has been seeked. The last position is kept if updatedAt is zero.
+func (t *positionTracker) update(
+	position, length int64,
+	updatedAt time.Time,
+	playing bool,
+) (seeked bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if updatedAt.IsZero() {
+		// the position is not reported without `media_position_updated_at`, keep the last one but
+		// re-anchor it once playing changes, so the paused time isn't extrapolated
+		if playing != t.playing {
+			now := time.Now()
+			t.position, t.updatedAt = t.extrapolate(now), now
+		}
+
+		t.length, t.playing = length, playing
+
+		return false
+	}
+
+	if !t.updatedAt.IsZero() && !updatedAt.Equal(t.updatedAt) {
+		diff := position - t.extrapolate(updatedAt)
+		seeked = diff > seekedThreshold || diff < -seekedThreshold
+	}
+
+	t.position, t.length, t.updatedAt, t.playing = position, length, updatedAt, playing
+
+	return seeked
+}
+
+// freeze stops extrapolating the position, e.g., when the connection to HASS is lost.
+func (t *positionTracker) freeze(now time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.position, t.updatedAt, t.playing = t.extrapolate(now), now, false
+}
+
+// set sets the position after the player seeked.
+func (t *positionTracker) set(position int64) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.position, t.updatedAt = position, time.Now()
+}
+
+// properties wraps the exported [prop.Properties] so the Position property is computed when
+// a client reads it instead of being updated and signalled periodically, and the writes of
+// [playerWriters] are forwarded to HASS without holding the properties locked.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Player_Interface.html#Property:Position
+type properties struct {
+	*prop.Properties
+	player *player
+}
+
+// Get implements org.freedesktop.DBus.Properties.Get.
+func (p *properties) Get(iface, property string) (dbus.Variant, *dbus.Error) {
+	if iface == dbusPlayerIface && property == "Position" {
+		return dbus.MakeVariant(p.player.tracker.current(time.Now())), nil
+	}
+
+	return p.Properties.Get(iface, property)
+}
+
+// GetAll implements org.freedesktop.DBus.Properties.GetAll.
+func (p *properties) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	props, err := p.Properties.GetAll(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	if iface == dbusPlayerIface {
+		props["Position"] = dbus.MakeVariant(p.player.tracker.current(time.Now()))
+	}
+
+	return props, nil
+}
+
+// Set implements org.freedesktop.DBus.Properties.Set, the property is only stored once HASS
+// accepted the write of [playerWriters] so a refused write is reported to the client.
+func (p *properties) Set(iface, property string, value dbus.Variant) *dbus.Error {
+	write, ok := playerWriters[property]
+	if iface != dbusPlayerIface || !ok {
+		return p.Properties.Set(iface, property, value)
+	}
+
+	value, err := write(p.player, value)
+	if err != nil {
+		return err
+	}
+
+	p.player.setProperty(iface, property, value)
+
+	return nil
+}
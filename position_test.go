@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPositionTrackerExtrapolate(t *testing.T) {
+	var tracker positionTracker
+
+	at := time.Now()
+	tracker.update(10*microsecond, 60*microsecond, at, true)
+
+	if got := tracker.current(at.Add(5 * time.Second)); got != 15*microsecond {
+		t.Errorf("position while playing: got %d, want %d", got, 15*microsecond)
+	}
+
+	if got := tracker.current(at.Add(time.Minute)); got != 60*microsecond {
+		t.Errorf("position past the length: got %d, want %d", got, 60*microsecond)
+	}
+
+	tracker.update(20*microsecond, 60*microsecond, at.Add(10*time.Second), false)
+
+	if got := tracker.current(at.Add(time.Minute)); got != 20*microsecond {
+		t.Errorf("position while paused: got %d, want %d", got, 20*microsecond)
+	}
+}
+
+func TestPositionTrackerSeeked(t *testing.T) {
+	var tracker positionTracker
+
+	at := time.Now()
+	tracker.update(10*microsecond, 0, at, true)
+
+	if tracker.update(20*microsecond, 0, at.Add(10*time.Second), true) {
+		t.Error("position as extrapolated: reported seeked")
+	}
+
+	if !tracker.update(50*microsecond, 0, at.Add(15*time.Second), true) {
+		t.Error("position jumped forward: not reported seeked")
+	}
+}
+
+func TestPositionTrackerMissingUpdatedAt(t *testing.T) {
+	var tracker positionTracker
+
+	tracker.update(30*microsecond, 0, time.Now().Add(-time.Hour), false)
+
+	if tracker.update(0, 0, time.Time{}, false) {
+		t.Error("missing updated at: reported seeked")
+	}
+
+	if got := tracker.current(time.Now()); got != 30*microsecond {
+		t.Fatalf("missing updated at: got %d, want the last position %d", got, 30*microsecond)
+	}
+
+	// resumed without `media_position_updated_at`, the paused hour must not be extrapolated
+	tracker.update(0, 0, time.Time{}, true)
+
+	if got := tracker.current(time.Now()); got < 30*microsecond || got > 31*microsecond {
+		t.Errorf("resumed without updated at: got %d, want about %d", got, 30*microsecond)
+	}
+}
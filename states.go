@@ -2,68 +2,52 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"os"
 
 	"github.com/charmbracelet/log"
 	"github.com/linnovs/hass-mpris-bridge/internal/hassmessage"
 )
 
-const (
-	headerAuthorization = "authorization"
-	headerContentType   = "content-type"
-	bearerTokenFmt      = "Bearer %s"
-	contentTypeJSON     = "application/json"
-)
-
-func getInitState(bdg *bridge) (success bool) {
-	apiUrl := bdg.hassURL.JoinPath("/api/states")
-
-	req, err := http.NewRequest(http.MethodGet, apiUrl.String(), nil)
+// getInitState fetches every state with `get_states` and syncs the bridge with them, this should
+// be called after subscribed to the state changes so no changes between them will be lost. The
+// IDs of every allowed `media_player` entity are returned.
+func getInitState(bdg *bridge) (entityIDs []string, success bool) {
+	msg, err := bdg.client.sendCommand(
+		bdg.ctx, hassmessage.Command{Type: hassmessage.TypeGetStates},
+	)
 	if err != nil {
-		log.Error("create HASS API request failed", "err", err)
-		return false
-	}
-
-	req.Header.Set(headerAuthorization, fmt.Sprintf(bearerTokenFmt, os.Getenv(envkeyToken)))
-	req.Header.Set(headerContentType, contentTypeJSON)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Error("failed to make request to HASS API", "err", err)
-		return false
-	}
-	defer resp.Body.Close()
+		if err == errCommandFailed {
+			log.Error("HASS get_states command failed", "err", msg.Error.Message)
+		} else {
+			log.Error("failed to send get_states command to HASS", "err", err)
+		}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Error("read response body from HASS API failed", "err", err)
-		return false
+		return nil, false
 	}
 
-	var states []hassmessage.State
+	var states, players []hassmessage.State
 
-	if err := json.Unmarshal(body, &states); err != nil {
-		log.Error("unmarshal response body from HASS API failed", "err", err)
-		return false
+	if err := json.Unmarshal(msg.Result, &states); err != nil {
+		log.Error("unmarshal get_states result from HASS failed", "err", err)
+		return nil, false
 	}
 
 	for _, state := range states {
-		if !state.IsMediaPlayer() || !state.IsMusicPlayer() {
+		if !state.IsMediaPlayer() || !bdg.cfg.allowed(state.EntityID) {
 			continue
 		}
 
 		log.Debug(
-			"state from api",
+			"state from get_states",
 			"entity", state.EntityID,
 			"state", state.State,
 			"attributes", string(state.Attributes),
 		)
 
-		bdg.update(state)
+		players = append(players, state)
+		entityIDs = append(entityIDs, state.EntityID)
 	}
 
-	return true
+	bdg.sync(players)
+
+	return entityIDs, true
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+	"github.com/linnovs/hass-mpris-bridge/internal/hassmessage"
+)
+
+const (
+	dbusTrackListIface          = dbusObjectIface + ".TrackList"
+	dbusTrackListReplacedSignal = dbusTrackListIface + ".TrackListReplaced"
+	queueNone                   = "none"
+)
+
+var (
+	errNoTrack           = errors.New("no such track")
+	errQueueNotSupported = errors.New("not supported by the player's queue")
+)
+
+// queueProvider is an integration which exposes the player's queue through service responses.
+type queueProvider struct {
+	domain hassmessage.ServiceDomain
+	parse  func(entityID string, result hassmessage.ServiceResult) ([]hassmessage.QueueItem, error)
+	goTo   func(p *player, index int) *dbus.Error
+	remove func(p *player, index int) *dbus.Error // nil if the integration can't remove tracks
+}
+
+// queueProviders are the supported integrations by the entity registry platform.
+var queueProviders = map[string]*queueProvider{
+	string(hassmessage.DomainSonos): {
+		domain: hassmessage.DomainSonos,
+		parse:  hassmessage.ParseSonosQueue,
+		goTo:   sonosQueueService(hassmessage.ServicePlayQueue),
+		remove: sonosQueueService(hassmessage.ServiceRemoveFromQueue),
+	},
+	string(hassmessage.DomainMusicAssistant): {
+		domain: hassmessage.DomainMusicAssistant,
+		parse:  hassmessage.ParseMusicAssistantQueue,
+		goTo:   musicAssistantGoTo,
+	},
+}
+
+// sonosQueueService calls the Sonos service taking the queue position, e.g., `play_queue`.
+func sonosQueueService(service hassmessage.ServiceType) func(p *player, index int) *dbus.Error {
+	return func(p *player, index int) *dbus.Error {
+		_, err := p.callDomainService(
+			hassmessage.DomainSonos,
+			service,
+			&hassmessage.CommandData{QueuePosition: &index},
+			false,
+		)
+
+		return err
+	}
+}
+
+// musicAssistantGoTo skips to the next item, Music Assistant only exposes the current and next
+// item of its queue.
+func musicAssistantGoTo(p *player, index int) *dbus.Error {
+	if index == 0 {
+		return nil
+	}
+
+	return p.callService(hassmessage.ServiceNext, nil)
+}
+
+// trackList implements `org.mpris.MediaPlayer2.TrackList` backed by the player's queue, it is
+// only enabled for the entities which integration is one of [queueProviders].
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Track_List_Interface.html
+type trackList struct {
+	mux        sync.Mutex
+	refreshMux sync.Mutex
+	player     *player
+	propsSpec  map[string]*prop.Prop
+	provider   *queueProvider
+	key        string // current track and queue of the latest state
+	tracks     []dbus.ObjectPath
+	positions  map[dbus.ObjectPath]int // position in the queue, including the skipped duplicates
+	metadata   map[dbus.ObjectPath]playerMetadata
+}
+
+// GetTracksMetadata returns the metadata of the tracks, unknown tracks are skipped.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Track_List_Interface.html#Method:GetTracksMetadata
+func (t *trackList) GetTracksMetadata(
+	trackIDs []dbus.ObjectPath,
+) ([]map[string]dbus.Variant, *dbus.Error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	metadata := make([]map[string]dbus.Variant, 0, len(trackIDs))
+
+	for _, trackID := range trackIDs {
+		if m, ok := t.metadata[trackID]; ok {
+			metadata = append(metadata, m)
+		}
+	}
+
+	return metadata, nil
+}
+
+// AddTrack enqueues the URI with `play_media`, HASS can only enqueue the track after the current
+// track or at the end of the queue.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Track_List_Interface.html#Method:AddTrack
+func (t *trackList) AddTrack(uri string, afterTrack dbus.ObjectPath, setAsCurrent bool) *dbus.Error {
+	if !t.canEditTracks() {
+		return nil
+	}
+
+	enqueue := hassmessage.EnqueueAdd
+
+	switch {
+	case setAsCurrent:
+		enqueue = hassmessage.EnqueuePlay
+	case afterTrack == t.player.trackID():
+		enqueue = hassmessage.EnqueueNext
+	}
+
+	return t.player.playMedia(uri, enqueue)
+}
+
+// RemoveTrack removes the track from the queue.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Track_List_Interface.html#Method:RemoveTrack
+func (t *trackList) RemoveTrack(trackID dbus.ObjectPath) *dbus.Error {
+	if !t.canEditTracks() {
+		return nil
+	}
+
+	provider, index := t.lookup(trackID)
+	if index < 0 {
+		return dbus.MakeFailedError(errNoTrack)
+	}
+
+	if provider.remove == nil {
+		return dbus.MakeFailedError(errQueueNotSupported)
+	}
+
+	return provider.remove(t.player, index)
+}
+
+// GoTo skips to the track in the queue.
+// see: https://specifications.freedesktop.org/mpris-spec/latest/Track_List_Interface.html#Method:GoTo
+func (t *trackList) GoTo(trackID dbus.ObjectPath) *dbus.Error {
+	provider, index := t.lookup(trackID)
+	if index < 0 {
+		log.Debug("ignore GoTo call with unknown track", "track", trackID)
+		return nil
+	}
+
+	return provider.goTo(t.player, index)
+}
+
+// lookup returns the queue provider and the track's position in the queue, -1 if not found.
+func (t *trackList) lookup(trackID dbus.ObjectPath) (*queueProvider, int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if t.provider == nil {
+		return nil, -1
+	}
+
+	position, ok := t.positions[trackID]
+	if !ok {
+		return t.provider, -1
+	}
+
+	return t.provider, position
+}
+
+func (t *trackList) enabled() bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	return t.provider != nil
+}
+
+// canEditTracks reports whether tracks can be added to the queue with `play_media`.
+func (t *trackList) canEditTracks() bool {
+	return t.enabled() &&
+		t.player.supports(hassmessage.MediaPlayerFeaturePlayMedia) &&
+		t.player.supports(hassmessage.MediaPlayerFeatureMediaEnqueue)
+}
+
+// capabilities returns the `CanEditTracks` property derived from the entity's features.
+func (t *trackList) capabilities() map[string]dbus.Variant {
+	return map[string]dbus.Variant{"CanEditTracks": dbus.MakeVariant(t.canEditTracks())}
+}
+
+// enable starts backing the track list by the queue of provider.
+func (t *trackList) enable(provider *queueProvider) {
+	t.mux.Lock()
+	t.provider = provider
+	t.mux.Unlock()
+
+	t.player.setProperty(dbusObjectIface, "HasTrackList", dbus.MakeVariant(true))
+
+	for k, v := range t.capabilities() {
+		t.player.setProperty(dbusTrackListIface, k, v)
+	}
+}
+
+// changed reports whether the current track or the queue has changed since the latest state.
+func (t *trackList) changed(state hassmessage.State) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	key := string(trackID(state)) + "/" + state.QueueKey()
+	if t.provider == nil || key == t.key {
+		return false
+	}
+
+	t.key = key
+
+	return true
+}
+
+// refresh fetches the queue and emits `TrackListReplaced` if the tracks have changed.
+func (t *trackList) refresh() {
+	t.refreshMux.Lock()
+	defer t.refreshMux.Unlock()
+
+	t.mux.Lock()
+	provider := t.provider
+	t.mux.Unlock()
+
+	if provider == nil {
+		return
+	}
+
+	entityID := t.player.entityID
+
+	result, derr := t.player.callDomainService(
+		provider.domain, hassmessage.ServiceGetQueue, nil, true,
+	)
+	if derr != nil {
+		log.Error("get player queue failed", "entity", entityID, "err", derr)
+		return
+	}
+
+	items, err := provider.parse(entityID, result)
+	if err != nil {
+		log.Error("parse player queue failed", "entity", entityID, "err", err)
+		return
+	}
+
+	tracks := make([]dbus.ObjectPath, 0, len(items))
+	positions := make(map[dbus.ObjectPath]int, len(items))
+	metadata := make(map[dbus.ObjectPath]playerMetadata, len(items))
+
+	for i, item := range items {
+		id := trackPath(entityID, item.ContentID, item.Title, item.Artist, item.Album)
+		if _, dup := metadata[id]; dup || id == dbusNoTrack {
+			// the track ID must be unique in the track list, the duplicated track is skipped
+			continue
+		}
+
+		tracks = append(tracks, id)
+		positions[id] = i
+		metadata[id] = queueItemMetadata(id, item)
+	}
+
+	t.mux.Lock()
+	replaced := !slices.Equal(t.tracks, tracks)
+	t.tracks, t.positions, t.metadata = tracks, positions, metadata
+	t.mux.Unlock()
+
+	if !replaced {
+		return
+	}
+
+	log.Debug("player queue changed", "entity", entityID, "tracks", len(tracks))
+
+	t.player.setProperty(dbusTrackListIface, "Tracks", dbus.MakeVariant(tracks))
+
+	err = t.player.conn.Emit(
+		dbusObjectPath, dbusTrackListReplacedSignal, tracks, t.player.trackID(),
+	)
+	if err != nil {
+		log.Error("emit TrackListReplaced signal failed", "err", err)
+	}
+}
+
+func (t *trackList) props() map[string]*prop.Prop {
+	if t.propsSpec != nil {
+		return t.propsSpec
+	}
+
+	t.propsSpec = map[string]*prop.Prop{
+		"Tracks":        {Value: []dbus.ObjectPath{}, Writable: false, Emit: prop.EmitInvalidates},
+		"CanEditTracks": {Value: false, Writable: false, Emit: prop.EmitTrue},
+	}
+
+	return t.propsSpec
+}